@@ -0,0 +1,160 @@
+// Copyright 2012 Petar Maymounkov. All rights reserved.
+// Use of this source code is governed by a 
+// license that can be found in the LICENSE file.
+
+package vcontext
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/petar/vitamix/vtime"
+)
+
+// WithDeadline is the virtualized version of context.WithDeadline. The
+// returned context is done when the virtual clock reaches d.
+func WithDeadline(parent context.Context, d time.Time) (context.Context, context.CancelFunc) {
+	return WithDeadlineCause(parent, d, nil)
+}
+
+// WithDeadlineCause is the virtualized version of context.WithDeadlineCause
+func WithDeadlineCause(parent context.Context, d time.Time, cause error) (context.Context, context.CancelFunc) {
+	if cur, ok := parent.Deadline(); ok && cur.Before(d) {
+		// The parent deadline is already sooner than the new one
+		return context.WithCancel(parent)
+	}
+	if cause == nil {
+		cause = context.DeadlineExceeded
+	}
+	c := &timerCtx{
+		deadline: d,
+		funcs:    make(map[*func()]struct{}),
+	}
+	c.Context, c.cancel = context.WithCancelCause(parent)
+	c.causeCtx, c.stopCause = context.WithCancel(c.Context)
+	// Contexts derived from c are canceled by close, which runs as soon as the
+	// inner context is canceled by the parent
+	context.AfterFunc(c.Context, c.close)
+	if dur := vtime.Until(d); dur <= 0 {
+		c.expire(cause)
+	} else {
+		c.timer = vtime.AfterFunc(dur, func() {
+			c.expire(cause)
+		})
+	}
+	return c, func() {
+		if c.timer != nil {
+			c.timer.Stop()
+		}
+		c.cancel(context.Canceled)
+		c.stopCause()
+		c.close()
+	}
+}
+
+// WithTimeout is the virtualized version of context.WithTimeout
+func WithTimeout(parent context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	return WithDeadline(parent, vtime.Now().Add(timeout))
+}
+
+// WithTimeoutCause is the virtualized version of context.WithTimeoutCause
+func WithTimeoutCause(parent context.Context, timeout time.Duration, cause error) (context.Context, context.CancelFunc) {
+	return WithDeadlineCause(parent, vtime.Now().Add(timeout), cause)
+}
+
+// timerCtx is a cancelable context, which is canceled by a virtual timer
+// when its deadline passes. The embedded context is the inner cancelable
+// context, whose cancellation reaches the timerCtx in the same call that
+// cancels its parent. The contexts derived from a timerCtx are canceled with
+// its Err, which is context.DeadlineExceeded once its deadline has passed.
+// The context package would attach them to the inner context instead, which
+// is canceled with context.Canceled, were it not hidden by Value.
+type timerCtx struct {
+	context.Context
+	cancel    context.CancelCauseFunc
+	causeCtx  context.Context    // Context derived from the inner one, which holds its cause
+	stopCause context.CancelFunc
+	deadline  time.Time
+	timer     *vtime.Timer
+
+	mu      sync.Mutex
+	expired bool
+	closed  bool
+	funcs   map[*func()]struct{} // Functions to call when the context is done
+}
+
+// expire cancels the context on account of its deadline passing
+func (c *timerCtx) expire(cause error) {
+	c.mu.Lock()
+	if c.Context.Err() == nil {
+		c.expired = true
+		c.cancel(cause)
+	}
+	c.mu.Unlock()
+	c.close()
+}
+
+// close calls the functions registered by AfterFunc, once the inner context
+// is canceled
+func (c *timerCtx) close() {
+	c.mu.Lock()
+	funcs := c.funcs
+	c.funcs, c.closed = nil, true
+	c.mu.Unlock()
+	for f := range funcs {
+		(*f)()
+	}
+}
+
+// AfterFunc arranges to call f after the context is done. The context package
+// cancels the contexts derived from c with it, in the goroutine that cancels c
+// or in which its deadline passes. If the parent of c is canceled, they are
+// canceled by the goroutine that the context package starts for close.
+func (c *timerCtx) AfterFunc(f func()) (stop func() bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		go f()
+		return func() bool { return false }
+	}
+	p := &f
+	c.funcs[p] = struct{}{}
+	return func() bool {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		_, ok := c.funcs[p]
+		delete(c.funcs, p)
+		return ok
+	}
+}
+
+// Deadline implements context.Context.Deadline
+func (c *timerCtx) Deadline() (time.Time, bool) {
+	return c.deadline, true
+}
+
+// Err implements context.Context.Err. As with the context package, a context
+// whose deadline has passed reports context.DeadlineExceeded, regardless of
+// the cause it was given.
+func (c *timerCtx) Err() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	err := c.Context.Err()
+	if err != nil && c.expired {
+		return context.DeadlineExceeded
+	}
+	return err
+}
+
+// Value implements context.Context.Value. In place of the inner context, which
+// the context package looks up to attach derived contexts to and to find the
+// cause of the cancellation, it returns the context derived from it, which
+// has the same cause but a done channel of its own.
+func (c *timerCtx) Value(key any) any {
+	v := c.Context.Value(key)
+	if v == c.Context {
+		return c.causeCtx.Value(key)
+	}
+	return v
+}
@@ -0,0 +1,117 @@
+// Copyright 2012 Petar Maymounkov. All rights reserved.
+// Use of this source code is governed by a 
+// license that can be found in the LICENSE file.
+
+package vcontext
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/petar/vitamix/vtime"
+)
+
+// wait waits for ctx to be done, as a virtualized receive would
+func wait(ctx context.Context) {
+	vtime.Block()
+	<-ctx.Done()
+	vtime.Unblock()
+}
+
+func TestWithTimeout(t *testing.T) {
+	s := vtime.NewScheduler()
+	s.Test(t)
+	s.Run(func() {
+		start := vtime.Now()
+		ctx, cancel := WithTimeout(context.Background(), time.Hour)
+		defer cancel()
+		if d, ok := ctx.Deadline(); !ok || !d.Equal(start.Add(time.Hour)) {
+			t.Errorf("deadline %v, expecting %v", d, start.Add(time.Hour))
+		}
+		if err := ctx.Err(); err != nil {
+			t.Errorf("error %v before the deadline", err)
+		}
+		wait(ctx)
+		if elapsed := vtime.Since(start); elapsed != time.Hour {
+			t.Errorf("done after %v, expecting %v", elapsed, time.Hour)
+		}
+		if err := ctx.Err(); err != context.DeadlineExceeded {
+			t.Errorf("error %v, expecting %v", err, context.DeadlineExceeded)
+		}
+		if cause := context.Cause(ctx); cause != context.DeadlineExceeded {
+			t.Errorf("cause %v, expecting %v", cause, context.DeadlineExceeded)
+		}
+	})
+}
+
+func TestDerived(t *testing.T) {
+	s := vtime.NewScheduler()
+	s.Test(t)
+	s.Run(func() {
+		errLate := errors.New("late")
+		ctx, cancel := WithTimeoutCause(context.Background(), time.Second, errLate)
+		defer cancel()
+		child, cancelChild := context.WithCancel(ctx)
+		defer cancelChild()
+		value := context.WithValue(ctx, "key", "value")
+		wait(child)
+		for _, c := range []context.Context{ ctx, child, value } {
+			if err := c.Err(); !errors.Is(err, context.DeadlineExceeded) {
+				t.Errorf("error %v, expecting %v", err, context.DeadlineExceeded)
+			}
+			if cause := context.Cause(c); cause != errLate {
+				t.Errorf("cause %v, expecting %v", cause, errLate)
+			}
+		}
+	})
+}
+
+func TestCancel(t *testing.T) {
+	s := vtime.NewScheduler()
+	s.Test(t)
+	s.Run(func() {
+		parent, cancelParent := context.WithCancel(context.Background())
+		ctx, cancel := WithTimeout(parent, time.Hour)
+		defer cancel()
+		child, cancelChild := context.WithCancel(ctx)
+		defer cancelChild()
+		cancelParent()
+		wait(child)
+		for _, c := range []context.Context{ ctx, child } {
+			if err := c.Err(); err != context.Canceled {
+				t.Errorf("error %v, expecting %v", err, context.Canceled)
+			}
+		}
+		ctx, cancel = WithTimeout(context.Background(), time.Hour)
+		cancel()
+		if err := ctx.Err(); err != context.Canceled {
+			t.Errorf("error %v, expecting %v", err, context.Canceled)
+		}
+	})
+}
+
+func TestCancelParent(t *testing.T) {
+	s := vtime.NewScheduler()
+	s.Test(t)
+	s.Run(func() {
+		parent, cancelParent := context.WithCancelCause(context.Background())
+		ctx, cancel := WithTimeout(parent, time.Second)
+		defer cancel()
+		errGone := errors.New("gone")
+		cancelParent(errGone)
+		select {
+		case <-ctx.Done():
+		default:
+			t.Errorf("not done after the parent was canceled")
+		}
+		vtime.Sleep(time.Hour)
+		if err := ctx.Err(); err != context.Canceled {
+			t.Errorf("error %v, expecting %v", err, context.Canceled)
+		}
+		if cause := context.Cause(ctx); cause != errGone {
+			t.Errorf("cause %v, expecting %v", cause, errGone)
+		}
+	})
+}
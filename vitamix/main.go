@@ -23,18 +23,22 @@ import (
 
 // TODO:
 //	* fallthrough in select statements is not supported. detect it and complain.
-//	* We only catch direct calls of the form 'time.Now()', 
-//	  we would not catch indirect calls as in 'f := time.Now; f()'
 
 func FilterGoFiles(fi os.FileInfo) bool {
 	name := fi.Name()
 	return !fi.IsDir() && !strings.HasPrefix(name, ".") && strings.HasSuffix(name, ".go")
 }
 
-const help = `vitamix InputSourceDir OutputSourceDir PkgPattern`
+const help = `vitamix [-limit Duration] [-events N] InputSourceDir OutputSourceDir PkgPattern`
+
+var (
+	flagLimit  = flag.Duration("limit", 0, "Stop virtualized programs after this much virtual time")
+	flagEvents = flag.Int64("events", 0, "Stop virtualized programs after this many sleeps, timers and breakpoints")
+)
 
 func usage() {
 	println(help)
+	flag.PrintDefaults()
 	os.Exit(1)
 }
 
@@ -49,6 +53,7 @@ func dump(filename string) {
 }
 
 func main() {
+	flag.Usage = usage
 	flag.Parse()
 	if flag.NArg() != 3 {
 		usage()
@@ -138,8 +143,8 @@ func rewriteDir(src, dest string) error {
 
 	// In every package, rewrite every file
 	for _, pkg := range pkgs {
+		RewritePackage(fileSet, pkg)
 		for _, fileFile := range pkg.Files {
-			RewriteFile(fileSet, fileFile)
 			position := fileSet.Position(fileFile.Package)
 			_, filename := path.Split(position.Filename)
 			fmt.Printf("  %s ==> %s\n", filename, path.Join(dest, filename))
@@ -148,6 +153,31 @@ func rewriteDir(src, dest string) error {
 				os.Exit(1)
 			}
 		}
+		if pkg.Name == "main" && (*flagLimit > 0 || *flagEvents > 0) {
+			if err = writeLimitFile(path.Join(dest, limitFile)); err != nil {
+				fmt.Fprintf(os.Stderr, "Problem writing limit file (%s)\n", err)
+				return err
+			}
+		}
 	}
 	return nil
 }
+
+const limitFile = "vitamix_limit.go"
+
+// writeLimitFile writes a source file that sets the limit given on the command
+// line, when the virtualized program starts
+func writeLimitFile(filename string) error {
+	fmt.Printf("  %s ==> %s\n", "(limit)", filename)
+	src := fmt.Sprintf(`// Code generated by vitamix. DO NOT EDIT.
+
+package main
+
+import "github.com/petar/vitamix/vtime"
+
+func init() {
+	vtime.SetLimit(%d, %d) // %s
+}
+`, int64(*flagLimit), *flagEvents, *flagLimit)
+	return os.WriteFile(filename, []byte(src), 0644)
+}
@@ -6,48 +6,148 @@ package vrewrite
 
 import (
 	"go/ast"
+	"go/types"
 )
 
+// virtualPkg describes a standard package, whose functions and types have
+// virtualized counterparts in another package
+type virtualPkg struct {
+	Name        string // Name and import path of the standard package
+	VirtualName string
+	Funcs       map[string]bool
+	Types       map[string]bool
+}
+
+// timePkg describes the virtualized portion of package time
+var timePkg = &virtualPkg{
+	Name:        "time",
+	VirtualName: "vtime",
+	Funcs: map[string]bool{
+		"Now":       true,
+		"Since":     true,
+		"Until":     true,
+		"Sleep":     true,
+		"NewTimer":  true,
+		"AfterFunc": true,
+		"After":     true,
+		"NewTicker": true,
+		"Tick":      true,
+	},
+	Types: map[string]bool{
+		"Timer":  true,
+		"Ticker": true,
+	},
+}
+
+// contextPkg describes the virtualized portion of package context
+var contextPkg = &virtualPkg{
+	Name:        "context",
+	VirtualName: "vcontext",
+	Funcs: map[string]bool{
+		"WithDeadline":      true,
+		"WithDeadlineCause": true,
+		"WithTimeout":       true,
+		"WithTimeoutCause":  true,
+	},
+}
+
 // rewriteTimeCalls converts source like
 //
 //		time.Now()
 //		time.Sleep(...)
+//		var t *time.Timer
+//		time.NewTicker(...)
 //
 // to
 //
 //		vtime.Now()
 //		vtime.Sleep(...)
+//		var t *vtime.Timer
+//		vtime.NewTicker(...)
 //
+// References are resolved by their types, so renamed and dot imports of time
+// and function values like sleep := time.Sleep are rewritten as well, while
+// selectors on anything else that is named time are not.
 // rewriteTimeCalls returns true if any code changes were made.
-func rewriteTimeCalls(file *ast.File) (needVtime bool) {
-	v := &callVisitor{}
-	ast.Walk(v, file)
-	return v.NeedPkgVtime
+func rewriteTimeCalls(file *ast.File, info *types.Info) (needVtime bool) {
+	return rewriteVirtualCalls(file, info, timePkg)
 }
 
-type callVisitor struct {
-	NeedPkgVtime bool
+// rewriteContextCalls converts calls like context.WithTimeout(...) to
+// vcontext.WithTimeout(...). It returns true if any code changes were made.
+func rewriteContextCalls(file *ast.File, info *types.Info) (needVcontext bool) {
+	return rewriteVirtualCalls(file, info, contextPkg)
 }
 
-func (v *callVisitor) Visit(x ast.Node) ast.Visitor {
-	callexpr, ok := x.(*ast.CallExpr)
-	if !ok || callexpr.Fun == nil {
-		return v
-	}
-	sexpr, ok := callexpr.Fun.(*ast.SelectorExpr)
-	if !ok {
-		return v
-	}
-	sx, ok := sexpr.X.(*ast.Ident)
-	if !ok {
-		return v
+func rewriteVirtualCalls(file *ast.File, info *types.Info, pkg *virtualPkg) bool {
+	var needPkgVirtual bool
+	walk(file, func(x interface{}) {
+		p, ok := x.(*ast.Expr)
+		if !ok {
+			return
+		}
+		switch q := (*p).(type) {
+		case *ast.SelectorExpr:
+			// A qualified reference, time.Now or t.Now
+			x, ok := q.X.(*ast.Ident)
+			if ok && pkg.Virtualizes(info.Uses[q.Sel]) {
+				x.Name = pkg.VirtualName
+				needPkgVirtual = true
+			}
+		case *ast.Ident:
+			// A reference by way of a dot import, Now
+			if pkg.Virtualizes(info.Uses[q]) {
+				*p = &ast.SelectorExpr{
+					X:   &ast.Ident{ NamePos: q.NamePos, Name: pkg.VirtualName },
+					Sel: q,
+				}
+				needPkgVirtual = true
+			}
+		}
+	})
+	return needPkgVirtual
+}
+
+// Virtualizes reports whether obj is a package-level function or type of the
+// standard package that has a virtualized counterpart
+func (pkg *virtualPkg) Virtualizes(obj types.Object) bool {
+	if obj == nil || obj.Pkg() == nil || obj.Pkg().Path() != pkg.Name || obj.Parent() != obj.Pkg().Scope() {
+		return false
 	}
-	if sx.Name != "time" {
-		return v
+	switch obj.(type) {
+	case *types.Func:
+		return pkg.Funcs[obj.Name()]
+	case *types.TypeName:
+		return pkg.Types[obj.Name()]
 	}
-	if sexpr.Sel.Name == "Now" || sexpr.Sel.Name == "Sleep" {
-		sx.Name = "vtime"
-		v.NeedPkgVtime = true
+	return false
+}
+
+// usesPkg reports whether file refers to the package with the given import path,
+// other than by the references that were rewritten to its virtualized counterpart
+func usesPkg(file *ast.File, info *types.Info, pkg *virtualPkg) bool {
+	var uses bool
+	var inspect func(ast.Node) bool
+	inspect = func(node ast.Node) bool {
+		switch q := node.(type) {
+		case *ast.SelectorExpr:
+			x, ok := q.X.(*ast.Ident)
+			if name, isPkg := info.Uses[x].(*types.PkgName); ok && isPkg {
+				// A rewritten selector has been renamed
+				uses = uses || name.Imported().Path() == pkg.Name && x.Name == name.Name()
+			} else {
+				ast.Inspect(q.X, inspect)
+			}
+			// The selected identifier is not a reference by itself
+			return false
+		case *ast.Ident:
+			obj := info.Uses[q]
+			if obj != nil && obj.Pkg() != nil && obj.Pkg().Path() == pkg.Name && obj.Parent() == obj.Pkg().Scope() {
+				uses = uses || !pkg.Virtualizes(obj)
+			}
+		}
+		return !uses
 	}
-	return v
+	ast.Inspect(file, inspect)
+	return uses
 }
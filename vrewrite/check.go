@@ -0,0 +1,35 @@
+// Copyright 2012 Petar Maymounkov. All rights reserved.
+// Use of this source code is governed by a 
+// license that can be found in the LICENSE file.
+
+package vrewrite
+
+import (
+	"go/ast"
+	"go/importer"
+	"go/token"
+	"go/types"
+	"runtime"
+)
+
+// typeCheck type-checks the files of a package and returns the type information
+// that the rewriter resolves identifiers with. Type errors are ignored, e.g. those
+// due to dependencies that cannot be imported, and the information is used as far
+// as it goes.
+func typeCheck(fset *token.FileSet, files []*ast.File) *types.Info {
+	info := &types.Info{
+		Types:     make(map[ast.Expr]types.TypeAndValue),
+		Instances: make(map[*ast.Ident]types.Instance),
+		Defs:      make(map[*ast.Ident]types.Object),
+		Uses:      make(map[*ast.Ident]types.Object),
+	}
+	if len(files) == 0 {
+		return info
+	}
+	conf := &types.Config{
+		Importer: importer.ForCompiler(fset, runtime.Compiler, nil),
+		Error:    func(error) {},
+	}
+	conf.Check(files[0].Name.Name, fset, files, info)
+	return info
+}
@@ -7,36 +7,57 @@ package vrewrite
 import (
 	"go/ast"
 	"go/token"
+	"go/types"
 )
 
+// RewriteFile rewrites a file, which makes up a package of its own
 func RewriteFile(fileSet *token.FileSet, file *ast.File) error {
+	return rewriteFile(fileSet, file, typeCheck(fileSet, []*ast.File{ file }))
+}
+
+// RewritePackage rewrites the files of a package, which are type-checked together
+func RewritePackage(fileSet *token.FileSet, pkg *ast.Package) error {
+	var files []*ast.File
+	for _, fileFile := range pkg.Files {
+		files = append(files, fileFile)
+	}
+	info := typeCheck(fileSet, files)
+	var err error
+	for _, fileFile := range files {
+		if err0 := rewriteFile(fileSet, fileFile, info); err0 != nil {
+			err = err0
+		}
+	}
+	return err
+}
+
+func rewriteFile(fileSet *token.FileSet, file *ast.File, info *types.Info) error {
 
 	// addImport will automatically rename any existing package references with
 	// conflicting name vtime to vtime_
 	addImport(file, "github.com/petar/vitamix/vtime")
+	addImport(file, "github.com/petar/vitamix/vcontext")
 
 	// rewriteTimeCalls will rewrite time.Now and time.Sleep to vtime.Now and vtime.Sleep
-	needVtime := rewriteTimeCalls(file)
-	needVtime = rewriteChanOps(fileSet, file) || needVtime
+	needVtime := rewriteTimeCalls(file, info)
+	needVtime = rewriteChanOps(fileSet, file, info) || needVtime
 
 	if !needVtime {
 		removeImport(file, "github.com/petar/vitamix/vtime")
 	}
 
+	// rewriteContextCalls will rewrite context.WithTimeout, etc., to vcontext.WithTimeout, etc.
+	if !rewriteContextCalls(file, info) {
+		removeImport(file, "github.com/petar/vitamix/vcontext")
+	}
+
 	// If there are no left references to pkg time, remove the import
-	if !ExistSelectorFor(file, "time") {
+	if !usesPkg(file, info, timePkg) {
 		removeImport(file, "time")
 	}
+	if !usesPkg(file, info, contextPkg) {
+		removeImport(file, "context")
+	}
 
 	return nil
 }
-
-func RewritePackage(fileSet *token.FileSet, pkg *ast.Package) error {
-	var err error
-	for _, fileFile := range pkg.Files {
-		if err0 := RewriteFile(fileSet, fileFile); err0 != nil {
-			err = err0
-		}
-	}
-	return err
-}
@@ -6,8 +6,11 @@ package vrewrite
 
 import (
 	"fmt"
+	"go/ast"
 	"go/token"
+	"go/types"
 	"os"
+	"strconv"
 )
 
 type framed interface {
@@ -19,19 +22,26 @@ type framed interface {
 type frame struct {
 	fileSet   *token.FileSet
 	errs      *ErrorQueue
+	ntemp     *int
+	scope     *fileScope
 	recursion int
 }
 
-// Init initializes a root-level frame
-func (t *frame) Init(fset *token.FileSet) {
+// Init initializes a root-level frame for rewriting node, given its type
+// information, if any
+func (t *frame) Init(fset *token.FileSet, node ast.Node, info *types.Info) {
 	t.fileSet = fset
 	t.errs = NewErrorQueue()
+	t.ntemp = new(int)
+	t.scope = newFileScope(node, info)
 }
 
 // InitRecurse initializes the frame from the calling frame
 func (t *frame) InitRecurse(caller framed) {
 	t.fileSet = caller.Frame().fileSet
 	t.errs = caller.Frame().errs
+	t.ntemp = caller.Frame().ntemp
+	t.scope = caller.Frame().scope
 	t.recursion = caller.Frame().recursion+1
 }
 
@@ -43,6 +53,13 @@ func (t *frame) Error() error {
 	return nil
 }
 
+// NewTemp returns an identifier for a new temporary variable, unique within the file
+func (t *frame) NewTemp() *ast.Ident {
+	name := "__vtime" + strconv.Itoa(*t.ntemp)
+	*t.ntemp++
+	return &ast.Ident{ Name: name }
+}
+
 // Printf prints to standard error while formating in a way reflecting the frame's recursive level
 func (t *frame) Printf(fmt_ string, args_ ...interface{}) {
 	for i := 0; i < t.recursion; i++ {
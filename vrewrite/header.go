@@ -0,0 +1,292 @@
+// Copyright 2012 Petar Maymounkov. All rights reserved.
+// Use of this source code is governed by a 
+// license that can be found in the LICENSE file.
+
+package vrewrite
+
+import (
+	"go/ast"
+	"go/token"
+	"strconv"
+)
+
+// rewriteIfStmt rewrites the receives in the header of an if statement, and in
+// the headers of the if statements chained to it by else, which are evaluated
+// only if the preceding conditions fail
+func (t *rewriteVisitor) rewriteIfStmt(ifstmt *ast.IfStmt) []ast.Stmt {
+	var hoisted []ast.Stmt
+	if countChanOps(ifstmt.Init) + countRecv(ifstmt.Cond) > 0 {
+		t.NeedPkgVtime = true
+		hoisted = t.moveInit(&ifstmt.Init)
+		hoisted = append(hoisted, t.liftExpr(&ifstmt.Cond)...)
+	}
+	t.recurse(ifstmt.Init)
+	t.recurse(ifstmt.Cond)
+	t.recurse(ifstmt.Body)
+	switch q := ifstmt.Else.(type) {
+	case *ast.IfStmt:
+		list := t.rewriteIfStmt(q)
+		if bstmt, ok := list[0].(*ast.BlockStmt); ok && len(list) == 1 {
+			ifstmt.Else = bstmt
+		} else if len(list) > 1 {
+			ifstmt.Else = &ast.BlockStmt{ Lbrace: q.Pos(), List: list, Rbrace: q.End() }
+		}
+	case *ast.BlockStmt:
+		t.recurse(q)
+	}
+	return enclose(hoisted, ifstmt)
+}
+
+// rewriteSwitchStmt rewrites the receives in the header and in the case expressions
+// of an expression switch statement
+func (t *rewriteVisitor) rewriteSwitchStmt(sw *ast.SwitchStmt) []ast.Stmt {
+	var hoisted []ast.Stmt
+	ncase := countRecv(sw.Body) - countBodyRecv(sw.Body)
+	if countChanOps(sw.Init) + countRecv(sw.Tag) + ncase > 0 {
+		t.NeedPkgVtime = true
+		hoisted = t.moveInit(&sw.Init)
+		hoisted = append(hoisted, t.liftExpr(&sw.Tag)...)
+	}
+	if ncase > 0 {
+		hoisted = append(hoisted, t.matchCases(sw)...)
+	}
+	t.recurse(sw.Init)
+	t.recurse(sw.Tag)
+	t.recurse(sw.Body)
+	return enclose(hoisted, sw)
+}
+
+// rewriteTypeSwitchStmt rewrites the receives in the header of a type switch statement
+func (t *rewriteVisitor) rewriteTypeSwitchStmt(ts *ast.TypeSwitchStmt) []ast.Stmt {
+	var hoisted []ast.Stmt
+	if countChanOps(ts.Init) + countRecv(ts.Assign) > 0 {
+		t.NeedPkgVtime = true
+		hoisted = t.moveInit(&ts.Init)
+		l := t.newLifter(ts.Assign)
+		switch q := ts.Assign.(type) {
+		case *ast.AssignStmt:
+			l.exprs(q.Rhs)
+		case *ast.ExprStmt:
+			l.expr(&q.X)
+		}
+		hoisted = append(hoisted, l.hoisted...)
+	}
+	t.recurse(ts.Init)
+	t.recurse(ts.Assign)
+	t.recurse(ts.Body)
+	return enclose(hoisted, ts)
+}
+
+// rewriteForStmt rewrites the receives in the header of a for statement. The
+// receives of the init statement are lifted before the loop, while the variables
+// that it declares stay in place, since each iteration has copies of its own.
+// A condition or post statement with receives moves to the top of the body,
+// where it is evaluated at the start of each iteration, like so:
+//
+//	for i := 0; i < <-n; i += <-step {
+//		...
+//	}
+//
+// is rewritten as
+//
+//	__vtime0 := true
+//	for i := 0; ; {
+//		if __vtime0 {
+//			__vtime0 = false
+//		} else {
+//			i += <-step
+//		}
+//		__vtime1 := <-n
+//		if !(i < __vtime1) {
+//			break
+//		}
+//		...
+//	}
+//
+// after which the receives are rewritten like any other.
+func (t *rewriteVisitor) rewriteForStmt(fstmt *ast.ForStmt) []ast.Stmt {
+	var hoisted, prologue []ast.Stmt
+	if countChanOps(fstmt.Init) > 0 {
+		t.NeedPkgVtime = true
+		hoisted = t.liftForInit(fstmt)
+	}
+	movePost := countChanOps(fstmt.Post) > 0
+	if movePost {
+		t.NeedPkgVtime = true
+		first := t.NewTemp()
+		hoisted = append(hoisted, &ast.AssignStmt{
+			Lhs:    []ast.Expr{ first },
+			TokPos: fstmt.For,
+			Tok:    token.DEFINE,
+			Rhs:    []ast.Expr{ &ast.Ident{ Name: "true" } },
+		})
+		prologue = append(prologue, &ast.IfStmt{
+			If:   fstmt.Post.Pos(),
+			Cond: &ast.Ident{ Name: first.Name },
+			Body: &ast.BlockStmt{
+				List: []ast.Stmt{
+					&ast.AssignStmt{
+						Lhs:    []ast.Expr{ &ast.Ident{ Name: first.Name } },
+						TokPos: fstmt.Post.Pos(),
+						Tok:    token.ASSIGN,
+						Rhs:    []ast.Expr{ &ast.Ident{ Name: "false" } },
+					},
+				},
+			},
+			Else: &ast.BlockStmt{ List: t.rewriteStmt(fstmt.Post) },
+		})
+		fstmt.Post = nil
+	}
+	// The condition is evaluated after the post statement
+	if fstmt.Cond != nil && (movePost || countRecv(fstmt.Cond) > 0) {
+		t.NeedPkgVtime = true
+		prologue = append(prologue, t.liftExpr(&fstmt.Cond)...)
+		t.recurse(fstmt.Cond)
+		cond := fstmt.Cond
+		if _, ok := cond.(*ast.Ident); !ok {
+			cond = &ast.ParenExpr{ X: cond }
+		}
+		prologue = append(prologue, &ast.IfStmt{
+			If:   fstmt.Cond.Pos(),
+			Cond: &ast.UnaryExpr{ OpPos: fstmt.Cond.Pos(), Op: token.NOT, X: cond },
+			Body: &ast.BlockStmt{ List: []ast.Stmt{ &ast.BranchStmt{ TokPos: fstmt.Cond.Pos(), Tok: token.BREAK } } },
+		})
+		fstmt.Cond = nil
+	}
+	t.recurse(fstmt)
+	fstmt.Body.List = append(prologue, fstmt.Body.List...)
+	return enclose(hoisted, fstmt)
+}
+
+// liftForInit lifts the receives of the init statement of a for statement and
+// returns the statements that precede the loop. An init statement that declares
+// no variables moves out of the loop altogether.
+func (t *rewriteVisitor) liftForInit(fstmt *ast.ForStmt) []ast.Stmt {
+	assign, ok := fstmt.Init.(*ast.AssignStmt)
+	if !ok || assign.Tok != token.DEFINE {
+		return t.moveInit(&fstmt.Init)
+	}
+	ue := singleRecv(assign.Rhs)
+	if ue == nil {
+		l := t.newLifter(assign)
+		l.exprs(assign.Rhs)
+		return l.hoisted
+	}
+	// A receive that assigns multiple values, v, ok := <-ch
+	var tmps, rhs []ast.Expr
+	for range assign.Lhs {
+		tmp := t.NewTemp()
+		tmps = append(tmps, tmp)
+		rhs = append(rhs, &ast.Ident{ Name: tmp.Name })
+	}
+	assign.Rhs = rhs
+	return t.rewriteStmt(&ast.AssignStmt{
+		Lhs:    tmps,
+		TokPos: assign.TokPos,
+		Tok:    token.DEFINE,
+		Rhs:    []ast.Expr{ ue },
+	})
+}
+
+// matchCases rewrites a switch statement with receives in its case expressions as
+// a switch on the index of the matching clause. The index is found beforehand by a
+// chain of if statements, which evaluates the case expressions in order, up to the
+// first one that matches.
+func (t *rewriteVisitor) matchCases(sw *ast.SwitchStmt) []ast.Stmt {
+	var hoisted []ast.Stmt
+	var tag ast.Expr
+	if sw.Tag != nil {
+		tag, hoisted = t.hoistExpr(nil, sw.Tag)
+		hoisted = t.rewriteStmt(hoisted[0])
+	}
+	c := t.NewTemp()
+	hoisted = append(hoisted, &ast.AssignStmt{
+		Lhs:    []ast.Expr{ c },
+		TokPos: sw.Switch,
+		Tok:    token.DEFINE,
+		Rhs:    []ast.Expr{ &ast.BasicLit{ ValuePos: sw.Switch, Kind: token.INT, Value: "0" } },
+	})
+	var matches []caseMatch
+	for i, clause := range sw.Body.List {
+		cc := clause.(*ast.CaseClause)
+		if cc.List == nil {
+			continue
+		}
+		index := &ast.BasicLit{ ValuePos: cc.Case, Kind: token.INT, Value: strconv.Itoa(i+1) }
+		for _, e := range cc.List {
+			if tag != nil {
+				e = &ast.BinaryExpr{ X: &ast.Ident{ NamePos: e.Pos(), Name: tag.(*ast.Ident).Name }, Op: token.EQL, Y: e }
+			}
+			matches = append(matches, caseMatch{ cond: e, index: index })
+		}
+		cc.List = []ast.Expr{ index }
+	}
+	sw.Tag = &ast.Ident{ Name: c.Name }
+	return append(hoisted, t.matchChain(c, matches)...)
+}
+
+// caseMatch is a condition under which a switch statement executes the clause at index
+type caseMatch struct {
+	cond  ast.Expr
+	index *ast.BasicLit
+}
+
+// matchChain returns the statements that assign the index of the first match whose
+// condition holds to c
+func (t *rewriteVisitor) matchChain(c *ast.Ident, matches []caseMatch) []ast.Stmt {
+	if len(matches) == 0 {
+		return nil
+	}
+	m := matches[0]
+	hoisted := t.liftExpr(&m.cond)
+	ifstmt := &ast.IfStmt{
+		If:   m.cond.Pos(),
+		Cond: m.cond,
+		Body: &ast.BlockStmt{
+			List: []ast.Stmt{
+				&ast.AssignStmt{
+					Lhs:    []ast.Expr{ &ast.Ident{ Name: c.Name } },
+					TokPos: m.cond.Pos(),
+					Tok:    token.ASSIGN,
+					Rhs:    []ast.Expr{ &ast.BasicLit{ Kind: token.INT, Value: m.index.Value } },
+				},
+			},
+		},
+	}
+	t.recurse(m.cond)
+	if rest := t.matchChain(c, matches[1:]); rest != nil {
+		ifstmt.Else = &ast.BlockStmt{ List: rest }
+	}
+	return append(hoisted, ifstmt)
+}
+
+// moveInit moves the init statement of an if, switch or for statement out of the
+// header and returns its rewrite
+func (t *rewriteVisitor) moveInit(init *ast.Stmt) []ast.Stmt {
+	if *init == nil {
+		return nil
+	}
+	list := t.rewriteStmt(*init)
+	*init = nil
+	return list
+}
+
+// liftExpr lifts the receives in the expression at p and returns the statements
+// that replace them
+func (t *rewriteVisitor) liftExpr(p *ast.Expr) []ast.Stmt {
+	l := t.newLifter(*p)
+	l.expr(p)
+	return l.hoisted
+}
+
+// countBodyRecv returns the number of receive operations in the bodies of the
+// clauses of a switch statement
+func countBodyRecv(body *ast.BlockStmt) int {
+	n := 0
+	for _, clause := range body.List {
+		for _, stmt := range clause.(*ast.CaseClause).Body {
+			n += countRecv(stmt)
+		}
+	}
+	return n
+}
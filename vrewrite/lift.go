@@ -0,0 +1,223 @@
+// Copyright 2012 Petar Maymounkov. All rights reserved.
+// Use of this source code is governed by a 
+// license that can be found in the LICENSE file.
+
+package vrewrite
+
+import (
+	"go/ast"
+	"go/token"
+)
+
+// lifter moves the receive operations nested inside the expressions of a statement
+// into temporaries, which are assigned by statements placed before it. Go evaluates
+// calls and receives in lexical left-to-right order, so calls that precede the last
+// receive of the statement are moved into temporaries as well. Everything else is
+// left in place, since its order of evaluation is unspecified.
+type lifter struct {
+	t       *rewriteVisitor
+	nrecv   int        // Number of receives that are yet to be lifted
+	hoisted []ast.Stmt // Statements that replace the lifted expressions
+}
+
+func (t *rewriteVisitor) newLifter(node ast.Node) *lifter {
+	return &lifter{ t: t, nrecv: countRecv(node) }
+}
+
+// countRecv returns the number of receive operations in node, other than those
+// inside function literals
+func countRecv(node ast.Node) int {
+	if node == nil {
+		return 0
+	}
+	n := 0
+	ast.Inspect(node, func(node ast.Node) bool {
+		switch q := node.(type) {
+		case *ast.FuncLit:
+			return false
+		case *ast.UnaryExpr:
+			if q.Op == token.ARROW {
+				n++
+			}
+		}
+		return true
+	})
+	return n
+}
+
+// countChanOps returns the number of receive and send operations in a simple
+// statement, other than those inside function literals
+func countChanOps(stmt ast.Stmt) int {
+	n := countRecv(stmt)
+	if _, ok := stmt.(*ast.SendStmt); ok {
+		n++
+	}
+	return n
+}
+
+func (l *lifter) exprs(list []ast.Expr) {
+	for i := range list {
+		l.expr(&list[i])
+	}
+}
+
+// call lifts the receives in the function value and in the arguments of call,
+// whose own evaluation stays in place
+func (l *lifter) call(call *ast.CallExpr) {
+	l.expr(&call.Fun)
+	l.exprs(call.Args)
+}
+
+// recv lifts the receives in the operand of ue, which itself stays in place
+func (l *lifter) recv(ue *ast.UnaryExpr) {
+	l.nrecv--
+	l.expr(&ue.X)
+}
+
+// expr lifts the receives in the expression at p, in order of evaluation
+func (l *lifter) expr(p *ast.Expr) {
+	if l.nrecv == 0 || *p == nil {
+		return
+	}
+	switch q := (*p).(type) {
+	case *ast.UnaryExpr:
+		if q.Op != token.ARROW {
+			l.expr(&q.X)
+			break
+		}
+		l.recv(q)
+		*p = l.hoist(q)
+	case *ast.CallExpr:
+		pure := isPureBuiltin(q)
+		if countRecv(q) == 0 && !pure {
+			*p = l.hoist(q)
+			break
+		}
+		l.call(q)
+		if l.nrecv > 0 && !pure {
+			*p = l.hoist(q)
+		}
+	case *ast.BinaryExpr:
+		if (q.Op == token.LAND || q.Op == token.LOR) && countRecv(q.Y) > 0 {
+			*p = l.shortCircuit(q)
+			break
+		}
+		l.expr(&q.X)
+		l.expr(&q.Y)
+	case *ast.ParenExpr:
+		l.expr(&q.X)
+	case *ast.SelectorExpr:
+		l.expr(&q.X)
+	case *ast.StarExpr:
+		l.expr(&q.X)
+	case *ast.TypeAssertExpr:
+		l.expr(&q.X)
+	case *ast.IndexExpr:
+		l.expr(&q.X)
+		l.expr(&q.Index)
+	case *ast.IndexListExpr:
+		l.expr(&q.X)
+	case *ast.SliceExpr:
+		l.expr(&q.X)
+		l.expr(&q.Low)
+		l.expr(&q.High)
+		l.expr(&q.Max)
+	case *ast.CompositeLit:
+		l.exprs(q.Elts)
+	case *ast.KeyValueExpr:
+		l.expr(&q.Key)
+		l.expr(&q.Value)
+	}
+}
+
+// shortCircuit lifts the conditional operator e, whose right operand contains
+// receives, into a temporary that is assigned the right operand only if the
+// left one does not decide the result
+func (l *lifter) shortCircuit(e *ast.BinaryExpr) ast.Expr {
+	l.expr(&e.X)
+	tmp := l.hoist(e.X)
+	y := &lifter{ t: l.t, nrecv: countRecv(e.Y) }
+	l.nrecv -= y.nrecv
+	y.expr(&e.Y)
+	var cond ast.Expr = &ast.Ident{ Name: tmp.Name }
+	if e.Op == token.LOR {
+		cond = &ast.UnaryExpr{ OpPos: e.OpPos, Op: token.NOT, X: cond }
+	}
+	body := append(y.hoisted, l.t.rewriteStmt(&ast.AssignStmt{
+		Lhs:    []ast.Expr{ &ast.Ident{ Name: tmp.Name } },
+		TokPos: e.OpPos,
+		Tok:    token.ASSIGN,
+		Rhs:    []ast.Expr{ e.Y },
+	})...)
+	l.hoisted = append(l.hoisted, &ast.IfStmt{
+		If:   e.OpPos,
+		Cond: cond,
+		Body: &ast.BlockStmt{ List: body },
+	})
+	return tmp
+}
+
+// hoist moves the evaluation of e into a new temporary and returns the temporary.
+// An expression that may be untyped gives the temporary the type it takes in its
+// context, such as the type of the other operand of a comparison or of &&.
+func (l *lifter) hoist(e ast.Expr) *ast.Ident {
+	tmp, hoisted := l.t.hoistExpr(nil, e)
+	l.hoisted = append(l.hoisted, l.t.rewriteStmt(hoisted[0])...)
+	return tmp.(*ast.Ident)
+}
+
+// enclose returns the statements that replace a statement whose parts were lifted
+// into hoisted, followed by list, which stands in for the statement itself. Unless
+// list declares names of its own, the temporaries and the variables of an init
+// statement that hoisted declares are enclosed in a block along with list, which
+// scopes them to the statement and keeps a goto from jumping over them.
+func enclose(hoisted []ast.Stmt, list ...ast.Stmt) []ast.Stmt {
+	if !declares(hoisted) || declares(list) {
+		return append(hoisted, list...)
+	}
+	return []ast.Stmt{
+		&ast.BlockStmt{ List: append(hoisted, list...) },
+	}
+}
+
+// declares reports whether any of the statements declares a name in the block
+// that holds it
+func declares(list []ast.Stmt) bool {
+	for _, stmt := range list {
+		switch q := stmt.(type) {
+		case *ast.AssignStmt:
+			if q.Tok == token.DEFINE {
+				return true
+			}
+		case *ast.DeclStmt:
+			return true
+		case *ast.LabeledStmt:
+			if declares([]ast.Stmt{ q.Stmt }) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// isPureBuiltin reports whether call is a call to a builtin function without side
+// effects. Such calls are not lifted, since their results may be untyped constants.
+func isPureBuiltin(call *ast.CallExpr) bool {
+	id, ok := call.Fun.(*ast.Ident)
+	if !ok {
+		return false
+	}
+	switch id.Name {
+	case "len", "cap", "complex", "real", "imag", "min", "max":
+		return true
+	}
+	return false
+}
+
+// singleRecv returns the receive operation that list consists of, if any
+func singleRecv(list []ast.Expr) *ast.UnaryExpr {
+	if len(list) != 1 {
+		return nil
+	}
+	return filterRecvExpr(list[0])
+}
@@ -13,7 +13,7 @@ import (
 // Prohibit creates a new prohibiting frame
 func Prohibit(fset *token.FileSet, node ast.Node) error {
 	v := &prohibitVisitor{}
-	v.frame.Init(fset)
+	v.frame.Init(fset, node, nil)
 	ast.Walk(v, node)
 	return v.Error()
 }
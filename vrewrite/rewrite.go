@@ -8,11 +8,12 @@ import (
 	"fmt"
 	"go/ast"
 	"go/token"
+	"go/types"
 	"os"
 )
 
-func rewriteChanOps(fset *token.FileSet, file *ast.File) bool {
-	needVtime, err := rewrite(fset, file)
+func rewriteChanOps(fset *token.FileSet, file *ast.File, info *types.Info) bool {
+	needVtime, err := rewrite(fset, file, info)
 	if err != nil {
 		//fmt.Fprintf(os.Stderr, "Rewrite errors parsing '%s':\n%s\n", file.Name.Name, err)
 		fmt.Fprintf(os.Stderr, "—— Encountered errors while parsing\n")
@@ -21,9 +22,9 @@ func rewriteChanOps(fset *token.FileSet, file *ast.File) bool {
 }
 
 // Rewrite creates a new rewriting frame
-func rewrite(fset *token.FileSet, node ast.Node) (bool, error) {
+func rewrite(fset *token.FileSet, node ast.Node, info *types.Info) (bool, error) {
 	rwv := &rewriteVisitor{}
-	rwv.frame.Init(fset)
+	rwv.frame.Init(fset, node, info)
 	ast.Walk(rwv, node)
 	return rwv.NeedPkgVtime, rwv.Error()
 }
@@ -56,136 +57,476 @@ func (t *rewriteVisitor) Visit(node ast.Node) ast.Visitor {
 	if node == nil {
 		return t
 	}
-	bstmt, ok := node.(*ast.BlockStmt)
-	// If node is not a block statement, it means we are recursing down the
-	// AST and we haven't hit a block statement yet. 
-	if !ok {
-		// Keep recursing
+	// Rewrite each statement of a block statement, or of the body of a case or
+	// comm clause, and stop the recursion of this visitor
+	switch q := node.(type) {
+	case *ast.BlockStmt:
+		q.List = t.rewriteList(q.List)
+	case *ast.CaseClause:
+		for _, e := range q.List {
+			t.recurse(e)
+		}
+		q.Body = t.rewriteList(q.Body)
+	case *ast.CommClause:
+		t.recurse(q.Comm)
+		q.Body = t.rewriteList(q.Body)
+	default:
+		// If node is none of the above, it means we are recursing down the
+		// AST and we haven't hit a statement list yet. 
 		return t
 	}
 
-	// Rewrite each statement of a block statement and stop the recursion of this visitor
+	// Do not continue the parent walk recursively
+	return nil
+}
+
+// rewriteList rewrites the statements of a statement list
+func (t *rewriteVisitor) rewriteList(stmts []ast.Stmt) []ast.Stmt {
 	var list []ast.Stmt
-	for _, stmt := range bstmt.List {
-		switch q := stmt.(type) {
-		case *ast.SelectStmt:
-			t.NeedPkgVtime = true
-			list = append(list, t.rewriteSelectStmt(q)...)
-		case *ast.SendStmt:
+	for _, stmt := range stmts {
+		list = append(list, t.rewriteStmt(stmt)...)
+	}
+	return list
+}
+
+// recurse rewrites the statement lists below node
+func (t *rewriteVisitor) recurse(node ast.Node) {
+	if node == nil {
+		return
+	}
+	needVtime, err := recurseRewrite(t, node)
+	if err != nil {
+		t.errs.Add(err)
+	}
+	t.NeedPkgVtime = t.NeedPkgVtime || needVtime
+}
+
+// rewriteStmt rewrites a statement of a statement list and returns the statements
+// that replace it
+func (t *rewriteVisitor) rewriteStmt(stmt ast.Stmt) []ast.Stmt {
+	switch q := stmt.(type) {
+	case *ast.SelectStmt:
+		t.NeedPkgVtime = true
+		return t.rewriteSelectStmt(q)
+	case *ast.SendStmt:
+		t.NeedPkgVtime = true
+		return t.rewriteSendStmt(q)
+	case *ast.GoStmt:
+		t.NeedPkgVtime = true
+		return t.rewriteGoStmt(q)
+	case *ast.LabeledStmt:
+		return t.rewriteLabeledStmt(q)
+	case *ast.RangeStmt:
+		if t.scope.IsChan(q.X) {
 			t.NeedPkgVtime = true
-			list = append(list, t.rewriteSendStmt(q)...)
-		case *ast.GoStmt:
+			return t.rewriteRangeStmt(q)
+		}
+	case *ast.IfStmt:
+		return t.rewriteIfStmt(q)
+	case *ast.SwitchStmt:
+		return t.rewriteSwitchStmt(q)
+	case *ast.TypeSwitchStmt:
+		return t.rewriteTypeSwitchStmt(q)
+	case *ast.ForStmt:
+		return t.rewriteForStmt(q)
+	case *ast.AssignStmt, *ast.ExprStmt, *ast.DeclStmt, *ast.DeferStmt, *ast.IncDecStmt, *ast.ReturnStmt:
+		if countRecv(stmt) > 0 {
 			t.NeedPkgVtime = true
-			list = append(list, t.rewriteGoStmt(q)...)
-		default:
-			if filterRecvStmt(stmt) != nil {
-				t.NeedPkgVtime = true
-				list = append(list, t.rewriteRecvStmt(stmt)...)
-			} else {
-				// Continue the walk recursively below this stmt
-				needVtime, err := recurseRewrite(t, stmt)
-				if err != nil {
-					t.errs.Add(err)
-				}
-				t.NeedPkgVtime = t.NeedPkgVtime || needVtime
-				list = append(list, stmt)
-			}
+			return t.rewriteRecvStmt(stmt)
 		}
 	}
-	bstmt.List = list
+	// Continue the walk recursively below this stmt
+	t.recurse(stmt)
+	return []ast.Stmt{ stmt }
+}
 
-	// Do not continue the parent walk recursively
+// rewriteLabeledStmt rewrites the statement that the label is attached to. The
+// label moves to the first statement of the rewrite, so that a goto to the label
+// still executes the statements lifted out of the statement and the call to Block
+// that precedes a channel operation. Break and continue statements that refer to
+// a for, switch or select statement, which may no longer come first, refer to a
+// new label on the statement instead.
+func (t *rewriteVisitor) rewriteLabeledStmt(lstmt *ast.LabeledStmt) []ast.Stmt {
+	list := t.rewriteStmt(lstmt.Stmt)
+	var p *ast.Stmt
+	if isBranchTarget(lstmt.Stmt) {
+		p = findBranchTarget(list)
+	}
+	if p == nil || p == &list[0] {
+		lstmt.Stmt, list[0] = list[0], lstmt
+		return list
+	}
+	if label := t.relabel(*p, lstmt.Label); label != nil {
+		*p = &ast.LabeledStmt{ Label: label, Colon: (*p).Pos(), Stmt: *p }
+	}
+	if t.scope.IsGotoTarget(lstmt.Label) {
+		lstmt.Stmt, list[0] = list[0], lstmt
+	}
+	return list
+}
+
+// relabel makes the break and continue statements in stmt that refer to label
+// refer to a new label, which it returns, or nil if there are no such statements.
+// Function literals have labels of their own.
+func (t *rewriteVisitor) relabel(stmt ast.Stmt, label *ast.Ident) *ast.Ident {
+	var name *ast.Ident
+	ast.Inspect(stmt, func(n ast.Node) bool {
+		switch q := n.(type) {
+		case *ast.FuncLit:
+			return false
+		case *ast.BranchStmt:
+			if q.Tok == token.GOTO || q.Label == nil || q.Label.Name != label.Name {
+				break
+			}
+			if name == nil {
+				name = t.NewTemp()
+			}
+			q.Label = &ast.Ident{ NamePos: q.Label.Pos(), Name: name.Name }
+		}
+		return true
+	})
+	return name
+}
+
+// findBranchTarget returns the location of the first branch target statement in
+// list, or in the blocks of list that enclose statements with their headers
+func findBranchTarget(list []ast.Stmt) *ast.Stmt {
+	for i, stmt := range list {
+		if isBranchTarget(stmt) {
+			return &list[i]
+		}
+		if bstmt, ok := stmt.(*ast.BlockStmt); ok {
+			if p := findBranchTarget(bstmt.List); p != nil {
+				return p
+			}
+		}
+	}
 	return nil
 }
 
+// isBranchTarget reports whether stmt, possibly labeled, is a statement whose label
+// break or continue statements may refer to
+func isBranchTarget(stmt ast.Stmt) bool {
+	switch q := stmt.(type) {
+	case *ast.LabeledStmt:
+		return isBranchTarget(q.Stmt)
+	case *ast.ForStmt, *ast.RangeStmt, *ast.SwitchStmt, *ast.TypeSwitchStmt, *ast.SelectStmt:
+		return true
+	}
+	return false
+}
+
+// rewriteRangeStmt rewrites a range loop over a channel as a loop that receives
+// explicitly, so that each receive is accounted for as blocking. The channel is
+// evaluated once, before the loop, as the range clause does. For instance,
+//
+//	for v := range ch {
+//		...
+//	}
+//
+// is rewritten as
+//
+//	__vtime0 := ch
+//	for {
+//		v, __vtime1 := <-__vtime0
+//		if !__vtime1 {
+//			break
+//		}
+//		...
+//	}
+//
+// after which the receive is rewritten like any other.
+func (t *rewriteVisitor) rewriteRangeStmt(rstmt *ast.RangeStmt) []ast.Stmt {
+	ch, hoisted := t.hoistExpr(nil, rstmt.X)
+	var v ast.Expr = &ast.Ident{ Name: "_" }
+	var assign []ast.Stmt
+	if rstmt.Key != nil {
+		if rstmt.Tok == token.DEFINE {
+			v = rstmt.Key
+		} else {
+			tmp := t.NewTemp()
+			v = tmp
+			assign = []ast.Stmt{
+				&ast.AssignStmt{
+					Lhs:    []ast.Expr{ rstmt.Key },
+					TokPos: rstmt.TokPos,
+					Tok:    token.ASSIGN,
+					Rhs:    []ast.Expr{ &ast.Ident{ Name: tmp.Name } },
+				},
+			}
+		}
+	}
+	ok := t.NewTemp()
+	body := []ast.Stmt{
+		&ast.AssignStmt{
+			Lhs:    []ast.Expr{ v, ok },
+			TokPos: rstmt.For,
+			Tok:    token.DEFINE,
+			Rhs:    []ast.Expr{ &ast.UnaryExpr{ OpPos: rstmt.For, Op: token.ARROW, X: ch } },
+		},
+		&ast.IfStmt{
+			If:   rstmt.For,
+			Cond: &ast.UnaryExpr{ OpPos: rstmt.For, Op: token.NOT, X: &ast.Ident{ Name: ok.Name } },
+			Body: &ast.BlockStmt{ List: []ast.Stmt{ &ast.BranchStmt{ TokPos: rstmt.For, Tok: token.BREAK } } },
+		},
+	}
+	body = append(append(body, assign...), rstmt.Body.List...)
+	fstmt := &ast.ForStmt{
+		For:  rstmt.For,
+		Body: &ast.BlockStmt{ Lbrace: rstmt.Body.Lbrace, List: body, Rbrace: rstmt.Body.Rbrace },
+	}
+	return enclose(t.rewriteStmt(hoisted[0]), t.rewriteStmt(fstmt)...)
+}
+
 func (t *rewriteVisitor) rewriteGoStmt(gostmt *ast.GoStmt) []ast.Stmt {
-	// Rewrite lower level nodes
-	recurseRewrite(t, gostmt.Call.Fun)
-	for _, arg := range gostmt.Call.Args {
-		// TODO: Handle the case when an argument contains chan operations
-		RecurseProhibit(t, arg)
+	// The go statement evaluates the function value and the arguments in the
+	// spawning goroutine. Move their evaluation out of the rewritten call into
+	// temporaries, which are assigned before the go statement.
+	// Receives in the arguments block the parent and are accounted for as such.
+	var list []ast.Stmt
+	for _, stmt := range t.hoistGoCall(gostmt.Call) {
+		list = append(list, t.rewriteStmt(stmt)...)
 	}
-	// Rewrite go statement itself
+	l := t.newLifter(gostmt.Call)
+	l.call(gostmt.Call)
+	list = append(list, l.hoisted...)
+	// Rewrite lower level nodes
+	recurseRewrite(t, gostmt.Call)
+	// Rewrite go statement itself. The spawned goroutine receives the record
+	// returned by vtime.Go from its parent and defers its exit, so that it is
+	// recorded even if the goroutine panics or calls runtime.Goexit.
+	g := t.NewTemp()
 	gostmt.Call = &ast.CallExpr{
 		Fun: &ast.FuncLit{
 			Type: &ast.FuncType{
-				Params: &ast.FieldList{},
+				Params: &ast.FieldList{
+					List: []*ast.Field{
+						&ast.Field{
+							Names: []*ast.Ident{ g },
+							Type:  &ast.StarExpr{
+								X: &ast.SelectorExpr{
+									X:   &ast.Ident{ Name: "vtime" },
+									Sel: &ast.Ident{ Name: "Goroutine" },
+								},
+							},
+						},
+					},
+				},
 			},
 			Body: &ast.BlockStmt{
 				List: []ast.Stmt{
+					makeSimpleCallStmt(g.Name, "Start", gostmt.Call.Pos()),
+					&ast.DeferStmt{
+						Defer: gostmt.Call.Pos(),
+						Call:  makeSimpleCall(g.Name, "Die", gostmt.Call.Pos()),
+					},
 					&ast.ExprStmt{ X: gostmt.Call },
-					makeSimpleCallStmt("vtime", "Die", gostmt.Call.Pos()),
 				},
 			},
 		},
+		Args: []ast.Expr{
+			makeSimpleCall("vtime", "Go", gostmt.Pos()),
+		},
 	}
-	return []ast.Stmt{
-		makeSimpleCallStmt("vtime", "Go", gostmt.Pos()),
-		gostmt,
+	return enclose(list, gostmt)
+}
+
+// hoistGoCall moves the function value and the arguments of the call in a go
+// statement into temporaries and returns their declarations. Function names,
+// instances of generic functions, function literals, functions of imported
+// packages and constant arguments are left in place, since they evaluate to the
+// same value in either goroutine, constants must stay untyped and generic
+// functions may not be used as values with type arguments left to inference.
+// So are function names among the arguments.
+// A lone call argument that returns multiple values is spread over as many
+// temporaries.
+func (t *rewriteVisitor) hoistGoCall(call *ast.CallExpr) []ast.Stmt {
+	var hoisted []ast.Stmt
+	switch q := call.Fun.(type) {
+	case *ast.FuncLit:
+	case *ast.Ident:
+		if !t.scope.IsFunc(q) {
+			call.Fun, hoisted = t.hoistExpr(hoisted, call.Fun)
+		}
+	case *ast.SelectorExpr:
+		if !t.scope.IsPkgSelector(q) {
+			call.Fun, hoisted = t.hoistExpr(hoisted, call.Fun)
+		}
+	case *ast.IndexExpr, *ast.IndexListExpr:
+		if !t.scope.IsInstance(call.Fun) {
+			call.Fun, hoisted = t.hoistExpr(hoisted, call.Fun)
+		}
+	default:
+		call.Fun, hoisted = t.hoistExpr(hoisted, call.Fun)
+	}
+	if len(call.Args) == 1 {
+		if arg, ok := call.Args[0].(*ast.CallExpr); ok {
+			return t.hoistMultiValue(hoisted, call, arg)
+		}
+	}
+	for i, arg := range call.Args {
+		if !t.scope.IsConst(arg) && !t.scope.IsFuncName(arg) {
+			call.Args[i], hoisted = t.hoistExpr(hoisted, arg)
+		}
+	}
+	return hoisted
+}
+
+// hoistMultiValue hoists arg, the only argument of call, which may return multiple
+// values. Without type information, the argument is left in place, and so is a
+// constant, such as a call to min on constants.
+func (t *rewriteVisitor) hoistMultiValue(hoisted []ast.Stmt, call, arg *ast.CallExpr) []ast.Stmt {
+	tv, ok := t.scope.typeOf(arg)
+	if !ok || tv.Value != nil {
+		return hoisted
+	}
+	tuple, ok := tv.Type.(*types.Tuple)
+	if !ok {
+		call.Args[0], hoisted = t.hoistExpr(hoisted, arg)
+		return hoisted
+	}
+	assign := &ast.AssignStmt{
+		TokPos: arg.Pos(),
+		Tok:    token.DEFINE,
+		Rhs:    []ast.Expr{ arg },
+	}
+	call.Args = nil
+	for i := 0; i < tuple.Len(); i++ {
+		tmp := t.NewTemp()
+		assign.Lhs = append(assign.Lhs, tmp)
+		call.Args = append(call.Args, &ast.Ident{ Name: tmp.Name })
 	}
+	return append(hoisted, assign)
 }
 
+// hoistExpr appends the declaration of a temporary holding the value of e to
+// hoisted and returns the temporary. An expression that may be untyped gives
+// the temporary the type it takes in its context.
+func (t *rewriteVisitor) hoistExpr(hoisted []ast.Stmt, e ast.Expr) (ast.Expr, []ast.Stmt) {
+	tmp := t.NewTemp()
+	if typ := t.scope.TypeExpr(e); typ != nil && t.scope.MayBeUntyped(e) {
+		hoisted = append(hoisted, &ast.DeclStmt{
+			Decl: &ast.GenDecl{
+				TokPos: e.Pos(),
+				Tok:    token.VAR,
+				Specs:  []ast.Spec{
+					&ast.ValueSpec{ Names: []*ast.Ident{ tmp }, Type: typ, Values: []ast.Expr{ e } },
+				},
+			},
+		})
+		return &ast.Ident{ Name: tmp.Name }, hoisted
+	}
+	hoisted = append(hoisted, &ast.AssignStmt{
+		Lhs:    []ast.Expr{ tmp },
+		TokPos: e.Pos(),
+		Tok:    token.DEFINE,
+		Rhs:    []ast.Expr{ e },
+	})
+	return &ast.Ident{ Name: tmp.Name }, hoisted
+}
+
+// rewriteRecvStmt rewrites a simple statement that contains receive operations.
+// Nested receives are lifted into temporaries. A receive that makes up the right
+// hand side of an assignment or an expression statement stays in place, and so
+// does the statement, which is then surrounded by calls to Block and Unblock.
 func (t *rewriteVisitor) rewriteRecvStmt(stmt ast.Stmt) []ast.Stmt {
-	// Prohibit inner blocks from having channel operation nodes
+	l := t.newLifter(stmt)
+	var ue *ast.UnaryExpr
 	switch q := stmt.(type) {
 	case *ast.AssignStmt:
-		for _, expr := range q.Lhs {
-			// TODO: Handle channel operations inside LHS of assignments
-			RecurseProhibit(t, expr)
-		}
-		for _, expr := range q.Rhs {
-			if expr == nil {
-				continue
-			}
-			// TODO: Handle channel operations inside RHS of assignments
-			if ue := filterRecvExpr(expr); ue != nil {
-				RecurseProhibit(t, ue.X)
-			} else {
-				RecurseProhibit(t, expr)
-			}
+		l.exprs(q.Lhs)
+		if ue = singleRecv(q.Rhs); ue != nil {
+			l.recv(ue)
+		} else {
+			l.exprs(q.Rhs)
 		}
 	case *ast.ExprStmt:
-		if q == nil {
-			break
+		if ue = filterRecvExpr(q.X); ue != nil {
+			l.recv(ue)
+		} else {
+			l.expr(&q.X)
 		}
-		// TODO: Handle channel operations inside RHS of assignments
-		if ue := filterRecvExpr(q.X); ue != nil {
-			RecurseProhibit(t, ue.X)
+	case *ast.DeclStmt:
+		gen := q.Decl.(*ast.GenDecl)
+		if len(gen.Specs) > 1 {
+			// Later specs may refer to the variables of earlier ones
+			return t.splitDeclStmt(gen)
+		}
+		spec := gen.Specs[0].(*ast.ValueSpec)
+		if ue = singleRecv(spec.Values); ue != nil {
+			l.recv(ue)
 		} else {
-			RecurseProhibit(t, q)
+			l.exprs(spec.Values)
 		}
+	case *ast.DeferStmt:
+		l.call(q.Call)
+	case *ast.IncDecStmt:
+		l.expr(&q.X)
+	case *ast.ReturnStmt:
+		l.exprs(q.Results)
 	default:
 		panic("unreach")
 	}
+	// Rewrite the function literals in the statement
+	t.recurse(stmt)
+	if ue == nil {
+		return enclose(l.hoisted, stmt)
+	}
 	// Rewrite receive statement itself
-	return []ast.Stmt{
+	return enclose(t.hoistTimerChan(l.hoisted, ue),
 		makeSimpleCallStmt("vtime", "Block", stmt.Pos()),
 		stmt,
 		makeSimpleCallStmt("vtime", "Unblock", stmt.Pos()),
+	)
+}
+
+// splitDeclStmt rewrites a declaration with multiple specs as a sequence of
+// declarations with one spec each
+func (t *rewriteVisitor) splitDeclStmt(gen *ast.GenDecl) []ast.Stmt {
+	var list []ast.Stmt
+	for _, spec := range gen.Specs {
+		decl := &ast.GenDecl{ TokPos: spec.Pos(), Tok: gen.Tok, Specs: []ast.Spec{ spec } }
+		list = append(list, t.rewriteStmt(&ast.DeclStmt{ Decl: decl })...)
 	}
+	return list
 }
 
 func (t *rewriteVisitor) rewriteSendStmt(sendstmt *ast.SendStmt) []ast.Stmt {
+	// Lift the receives in the channel and value of the send statement
+	l := t.newLifter(sendstmt)
+	l.expr(&sendstmt.Chan)
+	l.expr(&sendstmt.Value)
 	// Rewrite lower level nodes
-	// TODO: Allow channel operations inside channel and value fields of send expression
-	RecurseProhibit(t, sendstmt.Chan)
-	RecurseProhibit(t, sendstmt.Value)
+	t.recurse(sendstmt)
 	// Rewrite send statement itself
-	return []ast.Stmt{
+	return enclose(l.hoisted,
 		makeSimpleCallStmt("vtime", "Block", sendstmt.Pos()),
 		sendstmt,
 		makeSimpleCallStmt("vtime", "Unblock", sendstmt.Pos()),
-	}
+	)
 }
 
 func (t *rewriteVisitor) rewriteSelectStmt(selstmt *ast.SelectStmt) []ast.Stmt {
+	// A timer channel of a case is created before the call to vtime.Block, see
+	// hoistTimerChan. The channel operands and the values sent are evaluated in
+	// source order on entering the select, so the others are hoisted along with it.
+	var hoisted []ast.Stmt
+	if hasTimerChan(selstmt) {
+		for _, clause := range selstmt.Body.List {
+			for _, p := range commOperands(clause.(*ast.CommClause).Comm) {
+				if t.scope.IsConst(*p) {
+					continue
+				}
+				var decl []ast.Stmt
+				*p, decl = t.hoistExpr(nil, *p)
+				hoisted = append(hoisted, t.rewriteStmt(decl[0])...)
+			}
+		}
+	}
+
 	// Rewrite the comm clauses
 	for _, commclause := range selstmt.Body.List {
-		needVtime, err := recurseRewrite(t, commclause); 
-		if err != nil {
-			t.errs.Add(err)
-		}
-		t.NeedPkgVtime = t.NeedPkgVtime || needVtime
+		t.recurse(commclause)
 	}
 
 	// Place a call to Unblock immediately after each case and default
@@ -198,8 +539,73 @@ func (t *rewriteVisitor) rewriteSelectStmt(selstmt *ast.SelectStmt) []ast.Stmt {
 		)
 	}
 	// Surround the select by a block statement and prefix it with a call to vtime.Block
-	return []ast.Stmt{
+	return enclose(hoisted,
 		makeSimpleCallStmt("vtime", "Block", selstmt.Pos()),
 		selstmt,
+	)
+}
+
+// commOperands returns the locations of the channel operand of the communication
+// of a select case and of the value it sends, if any
+func commOperands(comm ast.Stmt) []*ast.Expr {
+	var ue *ast.UnaryExpr
+	switch q := comm.(type) {
+	case *ast.SendStmt:
+		return []*ast.Expr{ &q.Chan, &q.Value }
+	case *ast.ExprStmt:
+		ue = filterRecvExpr(q.X)
+	case *ast.AssignStmt:
+		ue = filterRecvExpr(q.Rhs[0])
+	}
+	if ue == nil {
+		return nil
+	}
+	return []*ast.Expr{ &ue.X }
+}
+
+// hasTimerChan reports whether a case of the select statement receives from a
+// call to vtime.After or vtime.Tick
+func hasTimerChan(selstmt *ast.SelectStmt) bool {
+	for _, clause := range selstmt.Body.List {
+		for _, p := range commOperands(clause.(*ast.CommClause).Comm) {
+			if filterTimerChanCall(*p) != nil {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// hoistTimerChan moves the operand of the receive expression ue into a temporary,
+// if the operand is a call to vtime.After or vtime.Tick, and appends the declaration
+// of the temporary to hoisted. The rewritten source thus creates the timer before
+// the call to vtime.Block, so a goroutine waiting on a timeout is accounted for as
+// sleeping until the timeout and the scheduler can advance straight to it.
+func (t *rewriteVisitor) hoistTimerChan(hoisted []ast.Stmt, ue *ast.UnaryExpr) []ast.Stmt {
+	if ue == nil || filterTimerChanCall(ue.X) == nil {
+		return hoisted
+	}
+	ue.X, hoisted = t.hoistExpr(hoisted, ue.X)
+	return hoisted
+}
+
+// If e is a call to vtime.After or vtime.Tick, filterTimerChanCall is the identity,
+// otherwise it returns nil
+func filterTimerChanCall(e ast.Expr) *ast.CallExpr {
+	call, ok := e.(*ast.CallExpr)
+	if !ok {
+		return nil
+	}
+	sexpr, ok := call.Fun.(*ast.SelectorExpr)
+	if !ok {
+		return nil
+	}
+	x, ok := sexpr.X.(*ast.Ident)
+	if !ok || x.Name != "vtime" {
+		return nil
+	}
+	if sexpr.Sel.Name != "After" && sexpr.Sel.Name != "Tick" {
+		return nil
 	}
+	return call
 }
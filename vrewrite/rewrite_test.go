@@ -115,6 +115,830 @@ __Label:
 B
 2000000000
 OK
+`,
+		},
+		testPair{
+			Source:
+`
+package main
+import "time"
+type watchdog struct {
+	t *time.Timer
+}
+func main() {
+	done := make(chan int)
+	w := &watchdog{ t: time.NewTimer(3*time.Second) }
+	time.AfterFunc(1*time.Second, func() {
+		println("F", time.Now().UnixNano())
+		done <- 1
+	})
+	<-done
+	println(w.t.Reset(2*time.Second))
+	stopped := time.NewTimer(time.Second)
+	println(stopped.Stop(), stopped.Stop())
+	t := <-w.t.C
+	println("T", t.UnixNano())
+}
+`,
+			Output:
+`F 1000000000
+true
+true false
+T 3000000000
+`,
+		},
+		testPair{
+			Source:
+`
+package main
+import "time"
+type sampler struct {
+	tick *time.Ticker
+}
+func main() {
+	s := &sampler{ tick: time.NewTicker(time.Second) }
+	for i := 0; i < 2; i++ {
+		t := <-s.tick.C
+		println(t.UnixNano())
+	}
+	time.Sleep(2500*time.Millisecond)
+	t := <-s.tick.C
+	println(t.UnixNano(), time.Now().UnixNano())
+	s.tick.Reset(2*time.Second)
+	t = <-s.tick.C
+	println(t.UnixNano())
+	s.tick.Stop()
+	<-time.Tick(time.Second)
+	println(time.Now().UnixNano())
+}
+`,
+			Output:
+`1000000000
+2000000000
+3000000000 4500000000
+6500000000
+7500000000
+`,
+		},
+		testPair{
+			Source:
+`
+package main
+import "time"
+func main() {
+	ch := make(chan int)
+	go func() {
+		time.Sleep(5*time.Second)
+		ch <- 1
+	}()
+	for {
+		select {
+		case <-ch:
+			println("V", time.Now().UnixNano())
+			return
+		case <-time.After(2*time.Second):
+			println("T", time.Now().UnixNano())
+		}
+	}
+}
+`,
+			Output:
+`T 2000000000
+T 4000000000
+V 5000000000
+`,
+		},
+		testPair{
+			Source:
+`
+package main
+import (
+	"strings"
+	"time"
+)
+func main() {
+	start := time.Now()
+	time.Sleep(1500*time.Millisecond)
+	println(time.Since(start).Nanoseconds())
+	println(time.Until(start.Add(2*time.Second)).Nanoseconds())
+	t := time.Now()
+	println(t.UnixNano(), t.Sub(start).Nanoseconds(), t.After(start))
+	println(strings.Contains(t.String(), " m="), strings.Contains(t.Round(0).String(), " m="))
+}
+`,
+			Output:
+`1500000000
+500000000
+1500000000 1500000000 true
+true false
+`,
+		},
+		testPair{
+			Source:
+`
+package main
+import (
+	"time"
+	"github.com/petar/vitamix/vtime"
+)
+func main() {
+	vtime.SetEpoch(time.Date(2012, 2, 29, 23, 59, 59, 0, time.UTC))
+	vtime.SetLocation(time.FixedZone("X", 3600))
+	t0 := time.Now()
+	time.Sleep(time.Second)
+	t1 := time.Now()
+	println(t0.Format(time.RFC3339), t1.Format(time.RFC3339), t1.Sub(t0).Nanoseconds())
+}
+`,
+			Output:
+`2012-03-01T00:59:59+01:00 2012-03-01T01:00:00+01:00 1000000000
+`,
+		},
+		testPair{
+			Source:
+`
+package main
+import (
+	"context"
+	"time"
+)
+func main() {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	d, _ := ctx.Deadline()
+	println(d.UnixNano())
+	<-ctx.Done()
+	println(time.Now().UnixNano(), ctx.Err() == context.DeadlineExceeded)
+	ctx, cancel = context.WithDeadline(context.Background(), time.Now().Add(time.Second))
+	cancel()
+	println(ctx.Err() == context.Canceled)
+	time.Sleep(2*time.Second)
+	println(time.Now().UnixNano())
+}
+`,
+			Output:
+`2000000000
+2000000000 true
+true
+4000000000
+`,
+		},
+		testPair{
+			Source:
+`
+package main
+import (
+	"os"
+	"time"
+	"github.com/petar/vitamix/vtime"
+)
+func main() {
+	vtime.OnDeadlock(func(d *vtime.Deadlock) {
+		println(len(d.Blocked), d.Elapsed.Nanoseconds(), d.Now.UnixNano())
+		os.Exit(0)
+	})
+	ch := make(chan int)
+	go func() {
+		<-ch
+	}()
+	time.Sleep(time.Second)
+	<-ch
+}
+`,
+			Output:
+`2 1000000000 1000000000
+`,
+		},
+		testPair{
+			Source:
+`
+package main
+import (
+	"runtime"
+	"time"
+)
+func main() {
+	go func() {
+		defer println("exit")
+		runtime.Goexit()
+	}()
+	time.Sleep(time.Second)
+	println(time.Now().UnixNano())
+}
+`,
+			Output:
+`exit
+1000000000
+`,
+		},
+		testPair{
+			Source:
+`
+package main
+import "time"
+type T struct{ x int }
+func (t T) Print(y int) { println(t.x, y, time.Now().UnixNano()) }
+func main() {
+	ch := make(chan int)
+	go func() {
+		time.Sleep(time.Second)
+		ch <- 2
+	}()
+	t, y := T{1}, 1
+	go t.Print(y)
+	go t.Print(<-ch)
+	t, y = T{3}, 3
+	time.Sleep(time.Second)
+}
+`,
+			Output:
+`1 1 0
+1 2 1000000000
+`,
+		},
+		testPair{
+			Source:
+`
+package main
+import "time"
+type T struct{ a, b int }
+func f(s string, x int) int { println(s, x, time.Now().UnixNano()); return x }
+func produce(ch chan int, n int) {
+	for i := 1; i <= n; i++ {
+		time.Sleep(time.Second)
+		ch <- i
+	}
+}
+func get(ch chan int) int { return <-ch }
+func main() {
+	ch := make(chan int)
+	go produce(ch, 10)
+	x := <-ch + <-ch
+	f("sum", x)
+	f("call", f("arg", 0) + <-ch)
+	var t T
+	t.a = <-ch
+	t = T{ a: <-ch, b: t.a }
+	f("lit", t.a * 10 + t.b)
+	defer f("defer", <-ch)
+	var (
+		y = <-ch
+		z = y + get(ch)
+	)
+	f("decl", z)
+	_ = x > 0 || <-ch > 0
+	out := make(chan int, 1)
+	out <- <-ch
+	f("send", <-out)
+}
+`,
+			Output:
+`sum 3 2000000000
+arg 0 2000000000
+call 3 3000000000
+lit 54 5000000000
+decl 15 8000000000
+send 9 9000000000
+defer 6 9000000000
+`,
+		},
+		testPair{
+			Source:
+`
+package main
+import "time"
+func main() {
+	ch := make(chan int)
+	go func() {
+		for i := 0; i < 3; i++ {
+			time.Sleep(time.Second)
+			ch <- i
+		}
+		close(ch)
+	}()
+	n := 0
+loop:
+	for {
+	wait:
+		select {
+		case x, ok := <-ch:
+			if !ok {
+				break loop
+			}
+			if x == 0 {
+				break wait
+			}
+			n += x
+		}
+	}
+	println(n, time.Now().UnixNano())
+	tick := make(chan int)
+	go func() {
+		for {
+			time.Sleep(time.Second)
+			tick <- 1
+		}
+	}()
+	i := 0
+again:
+	i += <-tick
+	if i < 3 {
+		goto again
+	}
+	println(i, time.Now().UnixNano())
+}
+`,
+			Output:
+`3 3000000000
+3 6000000000
+`,
+		},
+		testPair{
+			Source:
+`
+package main
+import "time"
+type Worker struct {
+	in  chan int
+	out chan<- int
+}
+func (w *Worker) Run() {
+	for x := range w.in {
+		time.Sleep(time.Second)
+		w.out <- x * x
+	}
+	close(w.out)
+}
+func feed(n int) <-chan int {
+	ch := make(chan int)
+	go func() {
+		for i := 1; i <= n; i++ {
+			ch <- i
+		}
+		close(ch)
+	}()
+	return ch
+}
+func main() {
+	out := make(chan int)
+	w := &Worker{ in: make(chan int), out: out }
+	go w.Run()
+	go func() {
+		for x := range feed(3) {
+			w.in <- x
+		}
+		close(w.in)
+	}()
+	var sum int
+	for sum = range out {
+		println(sum, time.Now().UnixNano())
+	}
+	n := 0
+	for range time.Tick(time.Second) {
+		if n++; n == 2 {
+			break
+		}
+	}
+	println(time.Now().UnixNano())
+}
+`,
+			Output:
+`1 1000000000
+4 2000000000
+9 3000000000
+5000000000
+`,
+		},
+		testPair{
+			Source:
+`
+package main
+import "time"
+func count(ch chan int, n int) {
+	for i := 1; i <= n; i++ {
+		time.Sleep(time.Second)
+		ch <- i
+	}
+}
+func print(s string, x int) { println(s, x, time.Now().UnixNano()) }
+func main() {
+	ch := make(chan int)
+	go count(ch, 100)
+	if v, ok := <-ch; ok {
+		print("if", v)
+	}
+	if <-ch == 0 {
+		print("never", 0)
+	} else if v := <-ch; v == 3 {
+		print("else if", v)
+	}
+	switch v := <-ch; v {
+	case 4:
+		print("switch", v)
+		select {
+		case v := <-ch:
+			print("select", v)
+		}
+	}
+	switch <-ch {
+	case 5, 6:
+		print("switch tag", 6)
+	}
+	switch 7 {
+	case 0, <-ch:
+		print("case", 7)
+		fallthrough
+	case <-ch:
+		print("fallthrough", 0)
+	}
+	var x interface{} = ch
+	switch c := x.(type) {
+	case chan int:
+		print("type switch", <-c)
+	}
+	switch y := interface{}(<-ch); y.(type) {
+	case int:
+		print("type switch init", y.(int))
+	}
+	for i, n := <-ch, 0; i < 14; i = <-ch {
+		print("for", i)
+		if n++; n == 2 {
+			continue
+		}
+	}
+	i := 0
+	for <-ch < 17 {
+		i++
+	}
+	print("for cond", i)
+}
+`,
+			Output:
+`if 1 1000000000
+else if 3 3000000000
+switch 4 4000000000
+select 5 5000000000
+switch tag 6 6000000000
+case 7 7000000000
+fallthrough 0 7000000000
+type switch 8 8000000000
+type switch init 9 9000000000
+for 10 10000000000
+for 11 11000000000
+for 12 12000000000
+for 13 13000000000
+for cond 2 17000000000
+`,
+		},
+		testPair{
+			Source:
+`
+package main
+import (
+	t "time"
+	. "time"
+)
+type clock struct {
+	now func() t.Time
+}
+func main() {
+	sleep := t.Sleep
+	c := clock{ now: Now }
+	sleep(Second)
+	println(c.now().UnixNano())
+	var timer *Timer = NewTimer(t.Second)
+	<-timer.C
+	println(Since(Unix(0, 0)) / t.Second)
+	time := struct{ Now func() int }{ func() int { return 7 } }
+	println(time.Now())
+}
+`,
+			Output:
+`1000000000
+2
+7
+`,
+		},
+		testPair{
+			Source:
+`
+package main
+import "time"
+type Pair[K comparable, V any] struct {
+	k  K
+	v  V
+	at time.Time
+}
+func send[T any](ch chan<- T, v T, d time.Duration) {
+	time.Sleep(d)
+	ch <- v
+}
+func pair[K comparable, V any](ch chan<- Pair[K, V], k K, v V) {
+	ch <- Pair[K, V]{ k: k, v: v, at: time.Now() }
+}
+func drain[C ~chan T, T any](c C, n int) []T {
+	var r []T
+	for v := range c {
+		if r = append(r, v); len(r) == n {
+			break
+		}
+	}
+	return r
+}
+func values(ch <-chan int) func(func(int) bool) {
+	return func(yield func(int) bool) {
+		for v := range ch {
+			if !yield(v) {
+				return
+			}
+		}
+	}
+}
+func main() {
+	ch := make(chan int)
+	go send[int](ch, 1, time.Second)
+	go send(ch, 2, 2*time.Second)
+	n := 0
+	for v := range values(ch) {
+		time.Sleep(time.Second)
+		println(v, time.Now().UnixNano())
+		if n++; n == 2 {
+			break
+		}
+	}
+	pc := make(chan Pair[string, int])
+	go pair[string, int](pc, "a", 1)
+	p := <-pc
+	println(p.k, p.v, p.at.UnixNano())
+	s := []int{ 1, 2, 3, 4 }[1:3:4]
+	sc := make(chan int)
+	go func() {
+		for _, x := range s {
+			send(sc, x, time.Second)
+		}
+	}()
+	r := drain(sc, len(s))
+	println(len(r), cap(s), r[0], r[1], time.Now().UnixNano())
+}
+`,
+			Output:
+`1 2000000000
+2 3000000000
+a 1 3000000000
+2 3 2 3 5000000000
+`,
+		},
+		testPair{
+			Source:
+`
+package main
+import "time"
+type flag bool
+var n int
+func next() int {
+	n++
+	return n
+}
+func pair() (int, string) {
+	return 7, "seven"
+}
+func identity[T any](x T) T {
+	return x
+}
+func apply(f func(int) int, x int, done chan bool) {
+	println(f(x))
+	done <- true
+}
+func fl(x float64) {
+	println(x)
+}
+func main() {
+	res := make(chan string)
+	f := func(int) { res <- "f1" }
+	go f(next())
+	f = func(int) { res <- "f2" }
+	println(n, <-res)
+	g := func(x int64, b flag) { println(x, b) }
+	k, a := 3, 1
+	go g(1<<k, a == 1)
+	time.Sleep(time.Second)
+	go func(x int, s string) { println(x, s) }(pair())
+	time.Sleep(time.Second)
+	done := make(chan bool)
+	go apply(identity, 3, done)
+	<-done
+	go fl(min(1, 2))
+	time.Sleep(time.Second)
+}
+`,
+			Output:
+`1 f1
+8 true
+7 seven
+3
+1
+`,
+		},
+		testPair{
+			Source:
+`
+package main
+func main() {
+	ch := make(chan int, 1)
+	ch <- 1
+	goto L
+	println(<-ch)
+	ch <- <-ch + 1
+	if <-ch > 0 {
+	}
+	go println(<-ch)
+L:
+	println(<-ch + 1)
+}
+`,
+			Output:
+`2
+`,
+		},
+		testPair{
+			Source:
+`
+package main
+import "time"
+func main() {
+	ch := make(chan int)
+	go func() {
+		time.Sleep(3500 * time.Millisecond)
+		ch <- 1
+	}()
+	n := 0
+retry:
+	select {
+	case v := <-ch:
+		println("got", v, n)
+	case <-time.After(time.Second):
+		n++
+		goto retry
+	}
+done:
+	select {
+	case <-time.After(time.Second):
+		if n > 0 {
+			break done
+		}
+		println("unreached")
+	}
+	println(time.Now().UnixNano())
+}
+`,
+			Output:
+`got 1 3
+4500000000
+`,
+		},
+		testPair{
+			Source:
+`
+package main
+import "time"
+func main() {
+	ch := make(chan int)
+	go func() {
+		for i := 1; i <= 3; i++ {
+			time.Sleep(time.Second)
+			ch <- i
+		}
+	}()
+	if v := func() int { return <-ch }(); v > 0 {
+		println(v, time.Now().UnixNano())
+	}
+	switch x := func() int { return <-ch }(); x {
+	case 2:
+		println(x, time.Now().UnixNano())
+	}
+	switch v := func() interface{} { return <-ch }(); q := v.(type) {
+	case int:
+		println(q, time.Now().UnixNano())
+	}
+}
+`,
+			Output:
+`1 1000000000
+2 2000000000
+3 3000000000
+`,
+		},
+		testPair{
+			Source:
+`
+package main
+import "time"
+func main() {
+	ch := make(chan int)
+	go func() {
+		for {
+			time.Sleep(time.Second)
+			println(<-ch, time.Now().UnixNano())
+		}
+	}()
+	if ch <- 1; len(ch) > 0 {
+		println("unreached")
+	}
+	switch ch <- 2; {
+	}
+	for i := 3; i < 5; ch <- i {
+		i++
+	}
+	time.Sleep(time.Second / 2)
+}
+`,
+			Output:
+`1 1000000000
+2 2000000000
+4 3000000000
+5 4000000000
+`,
+		},
+		testPair{
+			Source:
+`
+package main
+import (
+	"fmt"
+	"time"
+)
+type Chans interface{ ~chan int }
+type ticks chan int
+func (ticks) String() string { return "ticks" }
+func drain[C interface{ Chans; fmt.Stringer }](c C) {
+	for v := range c {
+		println(c.String(), v, time.Now().UnixNano())
+	}
+}
+func main() {
+	c := make(ticks)
+	go func() {
+		time.Sleep(time.Second)
+		c <- 1
+		close(c)
+	}()
+	drain(c)
+}
+`,
+			Output:
+`ticks 1 1000000000
+`,
+		},
+		testPair{
+			Source:
+`
+package main
+type B bool
+func main() {
+	bc := make(chan B, 2)
+	bc <- true
+	bc <- false
+	x, y := 1, 2
+	var b B = x < y && <-bc
+	c := x > y || <-bc
+	println(b, c)
+}
+`,
+			Output:
+`true false
+`,
+		},
+		testPair{
+			Source:
+`
+package main
+import "time"
+var order []string
+func next(ch chan int) chan int {
+	order = append(order, "next")
+	return ch
+}
+func timeout() time.Duration {
+	order = append(order, "timeout")
+	return time.Second
+}
+func main() {
+	ch := make(chan int)
+	x := 1
+	select {
+	case v := <-next(ch):
+		println(v)
+	case ch <- x << 2:
+		println("sent")
+	case <-time.After(timeout()):
+		println("timeout", time.Now().UnixNano())
+	}
+	println(order[0], order[1])
+}
+`,
+			Output:
+`timeout 1000000000
+next timeout
 `,
 		},
 	}
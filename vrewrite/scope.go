@@ -0,0 +1,411 @@
+// Copyright 2012 Petar Maymounkov. All rights reserved.
+// Use of this source code is governed by a 
+// license that can be found in the LICENSE file.
+
+package vrewrite
+
+import (
+	"go/ast"
+	"go/token"
+	"go/types"
+	"path"
+)
+
+// fileScope tells the rewriter what the expressions of a file are, by their type
+// information where it is available. Otherwise it goes by the names of the imported
+// packages and of the constants and struct fields declared in the file.
+type fileScope struct {
+	info    *types.Info          // Type information of the file, or nil
+	imports map[string]bool      // Names of the imported packages
+	paths   map[string]string    // Import paths of the imported packages, mapped to their names if renamed
+	pkg     string               // Name of the package of the file
+	consts  map[string]bool      // Names of constants declared anywhere in the file
+	fields  map[string]bool      // Names of struct fields, mapped to whether all fields by that name are channels
+	gotos   map[*ast.Object]bool // Labels that goto statements refer to
+}
+
+func newFileScope(node ast.Node, info *types.Info) *fileScope {
+	s := &fileScope{
+		info:    info,
+		imports: make(map[string]bool),
+		paths:   make(map[string]string),
+		consts:  map[string]bool{ "true": true, "false": true, "nil": true, "iota": true },
+		fields:  map[string]bool{ "C": true },
+		gotos:   make(map[*ast.Object]bool),
+	}
+	file, ok := node.(*ast.File)
+	if !ok {
+		return s
+	}
+	s.pkg = file.Name.Name
+	for _, spec := range file.Imports {
+		if spec.Name != nil {
+			s.imports[spec.Name.Name] = true
+			s.paths[importPath(spec)] = spec.Name.Name
+		} else {
+			s.paths[importPath(spec)] = ""
+			s.imports[path.Base(importPath(spec))] = true
+		}
+	}
+	ast.Inspect(file, func(n ast.Node) bool {
+		switch q := n.(type) {
+		case *ast.GenDecl:
+			if q.Tok != token.CONST {
+				break
+			}
+			for _, spec := range q.Specs {
+				for _, name := range spec.(*ast.ValueSpec).Names {
+					s.consts[name.Name] = true
+				}
+			}
+		case *ast.StructType:
+			for _, field := range q.Fields.List {
+				for _, name := range field.Names {
+					s.fields[name.Name] = isChanType(field.Type) && s.fieldIsChan(name.Name)
+				}
+			}
+		case *ast.BranchStmt:
+			if q.Tok == token.GOTO && q.Label.Obj != nil {
+				s.gotos[q.Label.Obj] = true
+			}
+		}
+		return true
+	})
+	return s
+}
+
+// fieldIsChan reports whether the struct fields by the given name seen so far are
+// channels. Fields named C are assumed to be the channels of timers and tickers.
+func (s *fileScope) fieldIsChan(name string) bool {
+	isChan, ok := s.fields[name]
+	return isChan || !ok
+}
+
+// IsConst reports whether e is a constant expression or nil. Without type information,
+// expressions made of literals, constants of the file and selectors on imported
+// packages, which refer to constants or to package-level functions and variables,
+// are taken for constants.
+func (s *fileScope) IsConst(e ast.Expr) bool {
+	if tv, ok := s.typeOf(e); ok {
+		return tv.Value != nil || tv.IsNil()
+	}
+	switch q := e.(type) {
+	case *ast.BasicLit:
+		return true
+	case *ast.Ident:
+		return s.consts[q.Name]
+	case *ast.SelectorExpr:
+		return s.IsPkgSelector(q)
+	case *ast.ParenExpr:
+		return s.IsConst(q.X)
+	case *ast.UnaryExpr:
+		return q.Op != token.ARROW && q.Op != token.AND && s.IsConst(q.X)
+	case *ast.BinaryExpr:
+		return s.IsConst(q.X) && s.IsConst(q.Y)
+	}
+	return false
+}
+
+// IsPkgSelector reports whether e is a selector on an imported package
+func (s *fileScope) IsPkgSelector(e *ast.SelectorExpr) bool {
+	x, ok := e.X.(*ast.Ident)
+	if !ok {
+		return false
+	}
+	if s.info != nil {
+		if obj, ok := s.info.Uses[x]; ok {
+			_, isPkg := obj.(*types.PkgName)
+			return isPkg
+		}
+	}
+	return s.imports[x.Name]
+}
+
+// IsFunc reports whether id names a function, rather than a variable holding one.
+// Without type information, all names are taken for functions.
+func (s *fileScope) IsFunc(id *ast.Ident) bool {
+	if s.info == nil {
+		return true
+	}
+	_, isVar := s.info.Uses[id].(*types.Var)
+	return !isVar
+}
+
+// IsFuncName reports whether e names a function declared at package level, in
+// the file's package or in an imported one. Only type information tells such
+// names apart from variables.
+func (s *fileScope) IsFuncName(e ast.Expr) bool {
+	if s.info == nil {
+		return false
+	}
+	var id *ast.Ident
+	switch q := e.(type) {
+	case *ast.Ident:
+		id = q
+	case *ast.SelectorExpr:
+		if !s.IsPkgSelector(q) {
+			return false
+		}
+		id = q.Sel
+	default:
+		return false
+	}
+	_, isFunc := s.info.Uses[id].(*types.Func)
+	return isFunc
+}
+
+// IsGotoTarget reports whether a goto statement refers to the label
+func (s *fileScope) IsGotoTarget(label *ast.Ident) bool {
+	return label.Obj != nil && s.gotos[label.Obj]
+}
+
+// IsInstance reports whether e, an index expression, instantiates a generic function.
+// Without type information, only instances with multiple type arguments are told
+// apart from indexing.
+func (s *fileScope) IsInstance(e ast.Expr) bool {
+	var x ast.Expr
+	switch q := e.(type) {
+	case *ast.IndexExpr:
+		x = q.X
+	case *ast.IndexListExpr:
+		if s.info == nil {
+			return true
+		}
+		x = q.X
+	default:
+		return false
+	}
+	if sel, ok := x.(*ast.SelectorExpr); ok {
+		x = sel.Sel
+	}
+	id, ok := x.(*ast.Ident)
+	if !ok || s.info == nil {
+		return false
+	}
+	_, ok = s.info.Instances[id]
+	return ok
+}
+
+// typeOf returns the type and value of e, if known
+func (s *fileScope) typeOf(e ast.Expr) (types.TypeAndValue, bool) {
+	if s.info == nil {
+		return types.TypeAndValue{}, false
+	}
+	tv, ok := s.info.Types[e]
+	return tv, ok && tv.Type != nil
+}
+
+// MayBeUntyped reports whether e, which is not a constant, may be untyped. Such
+// expressions are comparisons and shifts of constants, which take their type from
+// the context they are used in.
+func (s *fileScope) MayBeUntyped(e ast.Expr) bool {
+	switch q := e.(type) {
+	case *ast.ParenExpr:
+		return s.MayBeUntyped(q.X)
+	case *ast.UnaryExpr:
+		return q.Op != token.ARROW && q.Op != token.AND && s.MayBeUntyped(q.X)
+	case *ast.BinaryExpr:
+		switch q.Op {
+		case token.EQL, token.NEQ, token.LSS, token.LEQ, token.GTR, token.GEQ:
+			return true
+		case token.SHL, token.SHR:
+			return s.IsConst(q.X) || s.MayBeUntyped(q.X)
+		}
+		return (s.IsConst(q.X) || s.MayBeUntyped(q.X)) && (s.IsConst(q.Y) || s.MayBeUntyped(q.Y))
+	}
+	return false
+}
+
+// TypeExpr returns an expression for the type of e, which an untyped expression
+// takes from its context, or nil if the type is unknown or has no name in the file
+func (s *fileScope) TypeExpr(e ast.Expr) ast.Expr {
+	tv, ok := s.typeOf(e)
+	if !ok {
+		return nil
+	}
+	var obj *types.TypeName
+	switch q := types.Unalias(tv.Type).(type) {
+	case *types.Basic:
+		return &ast.Ident{ Name: types.Default(q).String() }
+	case *types.TypeParam:
+		obj = q.Obj()
+	case *types.Named:
+		if q.TypeArgs().Len() > 0 {
+			return nil
+		}
+		obj = q.Obj()
+	default:
+		return nil
+	}
+	pkg := obj.Pkg()
+	if pkg == nil {
+		return &ast.Ident{ Name: obj.Name() }
+	}
+	name, imported := s.paths[pkg.Path()]
+	switch {
+	case !imported && pkg.Name() == s.pkg, name == ".":
+		return &ast.Ident{ Name: obj.Name() }
+	case !imported || name == "_":
+		return nil
+	case name == "":
+		name = pkg.Name()
+	}
+	return &ast.SelectorExpr{ X: &ast.Ident{ Name: name }, Sel: &ast.Ident{ Name: obj.Name() } }
+}
+
+// IsChan reports whether e is a channel. Without type information, the type of e
+// is inferred from the declarations in the file: channels are made by make, returned
+// by functions and by vtime.After and vtime.Tick, or held in variables, parameters
+// and struct fields of channel type or initialized with channels.
+func (s *fileScope) IsChan(e ast.Expr) bool {
+	if tv, ok := s.typeOf(e); ok {
+		return hasChanCore(tv.Type)
+	}
+	return s.isChan(e, 0)
+}
+
+// hasChanCore reports whether t is a channel type, or a type parameter whose
+// type set consists of channel types only
+func hasChanCore(t types.Type) bool {
+	if tp, ok := t.(*types.TypeParam); ok {
+		return chanTypeSet(tp.Constraint())
+	}
+	_, isChan := t.Underlying().(*types.Chan)
+	return isChan
+}
+
+// chanTypeSet reports whether the type set of the constraint consists of channel
+// types only. The type set is the intersection of the type sets of the elements
+// embedded in the constraint, among them other constraints, so it suffices that
+// one of them consists of channel types.
+func chanTypeSet(constraint types.Type) bool {
+	iface, ok := constraint.Underlying().(*types.Interface)
+	if !ok {
+		return false
+	}
+	for i := 0; i < iface.NumEmbeddeds(); i++ {
+		switch q := iface.EmbeddedType(i).(type) {
+		case *types.Union:
+			if unionIsChan(q) {
+				return true
+			}
+		default:
+			if _, ok := q.Underlying().(*types.Interface); ok {
+				if chanTypeSet(q) {
+					return true
+				}
+			} else if hasChanCore(q) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// unionIsChan reports whether all terms of the union are channel types
+func unionIsChan(union *types.Union) bool {
+	for i := 0; i < union.Len(); i++ {
+		if !hasChanCore(union.Term(i).Type()) {
+			return false
+		}
+	}
+	return true
+}
+
+// maxInferDepth bounds the chains of declarations followed by IsChan
+const maxInferDepth = 8
+
+func (s *fileScope) isChan(e ast.Expr, depth int) bool {
+	if depth > maxInferDepth {
+		return false
+	}
+	switch q := e.(type) {
+	case *ast.ParenExpr:
+		return s.isChan(q.X, depth)
+	case *ast.SelectorExpr:
+		if s.IsPkgSelector(q) {
+			return false
+		}
+		return s.fields[q.Sel.Name]
+	case *ast.CallExpr:
+		return s.callIsChan(q)
+	case *ast.Ident:
+		if q.Obj == nil || q.Obj.Kind != ast.Var {
+			return false
+		}
+		switch decl := q.Obj.Decl.(type) {
+		case *ast.Field:
+			return isChanType(decl.Type)
+		case *ast.ValueSpec:
+			if decl.Type != nil {
+				return isChanType(decl.Type)
+			}
+			return s.isChan(valueOf(q.Name, decl.Names, decl.Values), depth+1)
+		case *ast.AssignStmt:
+			var names []*ast.Ident
+			for _, lhs := range decl.Lhs {
+				id, _ := lhs.(*ast.Ident)
+				names = append(names, id)
+			}
+			return s.isChan(valueOf(q.Name, names, decl.Rhs), depth+1)
+		}
+	}
+	return false
+}
+
+// callIsChan reports whether call evidently returns a channel
+func (s *fileScope) callIsChan(call *ast.CallExpr) bool {
+	switch fun := call.Fun.(type) {
+	case *ast.Ident:
+		if fun.Name == "make" && fun.Obj == nil && len(call.Args) > 0 {
+			return isChanType(call.Args[0])
+		}
+		if fun.Obj == nil || fun.Obj.Kind != ast.Fun {
+			return isChanType(fun)
+		}
+		decl, ok := fun.Obj.Decl.(*ast.FuncDecl)
+		if !ok {
+			return false
+		}
+		results := decl.Type.Results
+		return results != nil && len(results.List) == 1 && len(results.List[0].Names) <= 1 &&
+			isChanType(results.List[0].Type)
+	case *ast.SelectorExpr:
+		x, ok := fun.X.(*ast.Ident)
+		return ok && x.Name == "vtime" && (fun.Sel.Name == "After" || fun.Sel.Name == "Tick")
+	}
+	// A conversion to a channel type
+	return isChanType(call.Fun)
+}
+
+// valueOf returns the value assigned to the named variable by a declaration or
+// assignment of one value per name
+func valueOf(name string, names []*ast.Ident, values []ast.Expr) ast.Expr {
+	if len(names) != len(values) {
+		return nil
+	}
+	for i, id := range names {
+		if id != nil && id.Name == name {
+			return values[i]
+		}
+	}
+	return nil
+}
+
+// isChanType reports whether the type expression t denotes a channel type,
+// possibly by the name of a type declared in the file
+func isChanType(t ast.Expr) bool {
+	switch q := t.(type) {
+	case *ast.ParenExpr:
+		return isChanType(q.X)
+	case *ast.ChanType:
+		return true
+	case *ast.Ident:
+		if q.Obj == nil || q.Obj.Kind != ast.Typ {
+			return false
+		}
+		spec, ok := q.Obj.Decl.(*ast.TypeSpec)
+		return ok && spec.Type != q && isChanType(spec.Type)
+	}
+	return false
+}
@@ -11,13 +11,17 @@ import (
 
 func makeSimpleCallStmt(pkgAlias, funcName string, pos token.Pos) ast.Stmt {
 	return &ast.ExprStmt{
-		X: &ast.CallExpr{
-			Fun: &ast.SelectorExpr{
-				X:   &ast.Ident{ Name: pkgAlias },
-				Sel: &ast.Ident{ Name: funcName },
-			},
-			Lparen: pos,
+		X: makeSimpleCall(pkgAlias, funcName, pos),
+	}
+}
+
+func makeSimpleCall(pkgAlias, funcName string, pos token.Pos) *ast.CallExpr {
+	return &ast.CallExpr{
+		Fun: &ast.SelectorExpr{
+			X:   &ast.Ident{ Name: pkgAlias },
+			Sel: &ast.Ident{ Name: funcName },
 		},
+		Lparen: pos,
 	}
 }
 
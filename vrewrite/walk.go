@@ -91,6 +91,9 @@ func walkBeforeAfter(x interface{}, before, after func(interface{})) {
 	case *ast.IndexExpr:
 		walkBeforeAfter(&n.X, before, after)
 		walkBeforeAfter(&n.Index, before, after)
+	case *ast.IndexListExpr:
+		walkBeforeAfter(&n.X, before, after)
+		walkBeforeAfter(&n.Indices, before, after)
 	case *ast.SliceExpr:
 		walkBeforeAfter(&n.X, before, after)
 		if n.Low != nil {
@@ -99,6 +102,9 @@ func walkBeforeAfter(x interface{}, before, after func(interface{})) {
 		if n.High != nil {
 			walkBeforeAfter(&n.High, before, after)
 		}
+		if n.Max != nil {
+			walkBeforeAfter(&n.Max, before, after)
+		}
 	case *ast.TypeAssertExpr:
 		walkBeforeAfter(&n.X, before, after)
 		walkBeforeAfter(&n.Type, before, after)
@@ -122,6 +128,9 @@ func walkBeforeAfter(x interface{}, before, after func(interface{})) {
 	case *ast.StructType:
 		walkBeforeAfter(&n.Fields, before, after)
 	case *ast.FuncType:
+		if n.TypeParams != nil {
+			walkBeforeAfter(&n.TypeParams, before, after)
+		}
 		walkBeforeAfter(&n.Params, before, after)
 		if n.Results != nil {
 			walkBeforeAfter(&n.Results, before, after)
@@ -197,6 +206,9 @@ func walkBeforeAfter(x interface{}, before, after func(interface{})) {
 		walkBeforeAfter(&n.Values, before, after)
 		walkBeforeAfter(&n.Names, before, after)
 	case *ast.TypeSpec:
+		if n.TypeParams != nil {
+			walkBeforeAfter(&n.TypeParams, before, after)
+		}
 		walkBeforeAfter(&n.Type, before, after)
 
 	case *ast.BadDecl:
@@ -0,0 +1,45 @@
+// Copyright 2012 Petar Maymounkov. All rights reserved.
+// Use of this source code is governed by a 
+// license that can be found in the LICENSE file.
+
+package vtime
+
+import (
+	"time"
+)
+
+// At sets a breakpoint at the virtual time t on the scheduler of the calling
+// goroutine. See Scheduler.At.
+func At(t time.Time, f func()) {
+	current().At(t, f)
+}
+
+// At sets a breakpoint at the virtual time t. When the virtual clock reaches t,
+// the scheduler calls f while all goroutines of the program are blocked, before
+// it releases the goroutines sleeping until t and fires the timers due at t. The
+// function f thus observes a consistent snapshot of the program at t, e.g.
+//
+//	vtime.At(epoch.Add(3500*time.Millisecond), func() {
+//		if out := actuator.Output(); out > max {
+//			t.Errorf("actuator output %v at 3.5s", out)
+//		}
+//	})
+//
+// Breakpoints at the same instant are called in the order in which they were set.
+// A breakpoint in the past is called at the current virtual time. The function f
+// must not sleep or block in channel operations, but it may start goroutines.
+func (s *Scheduler) At(t time.Time, f func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u := makeUntil(int64(t.Sub(s.epoch))-s.now, s.now)
+	u.at = f
+	s.q.Add(u)
+	s.changed()
+}
+
+// breakpoint calls the breakpoint function f on behalf of the scheduler, so that
+// f and the goroutines it starts use the scheduler's clock
+func (s *Scheduler) breakpoint(f func()) {
+	defer s.bind()()
+	f()
+}
@@ -0,0 +1,225 @@
+// Copyright 2012 Petar Maymounkov. All rights reserved.
+// Use of this source code is governed by a 
+// license that can be found in the LICENSE file.
+
+package vtime
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"reflect"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Deadlock describes a state of the virtualized program, in which all goroutines
+// are blocked in channel operations and no sleeps or timers are pending
+type Deadlock struct {
+	Now     time.Time          // Virtual time of the deadlock
+	Elapsed time.Duration      // Virtual time elapsed since the epoch
+	Blocked []BlockedGoroutine // Blocked goroutines, ordered by ID
+}
+
+// BlockedGoroutine describes a goroutine blocked in a channel operation or asleep
+type BlockedGoroutine struct {
+	ID       int64  // Goroutine identifier assigned by the Go runtime
+	Name     string // Name given by Name, if any
+	Sleeping bool   // Whether the goroutine is asleep rather than in a channel operation
+	File     string // Position of the blocking operation in the virtualized source
+	Line     int
+
+	// The goroutine that spawned this one, if any, and the position of the go
+	// statement in the virtualized source
+	Parent    int64
+	SpawnFile string
+	SpawnLine int
+}
+
+func (g BlockedGoroutine) String() string {
+	var w bytes.Buffer
+	fmt.Fprintf(&w, "goroutine %d", g.ID)
+	if g.Name != "" {
+		fmt.Fprintf(&w, " (%s)", g.Name)
+	}
+	verb := "blocked"
+	if g.Sleeping {
+		verb = "sleeping"
+	}
+	fmt.Fprintf(&w, " %s at %s:%d", verb, g.File, g.Line)
+	if g.Parent != 0 {
+		fmt.Fprintf(&w, ", spawned by goroutine %d at %s:%d", g.Parent, g.SpawnFile, g.SpawnLine)
+	}
+	return string(w.Bytes())
+}
+
+func (d *Deadlock) Error() string {
+	var w bytes.Buffer
+	fmt.Fprintf(&w, "vtime: all goroutines are blocked - deadlock at virtual time %s (%s since epoch)",
+		d.Now.Format(time.RFC3339Nano), d.Elapsed)
+	for _, g := range d.Blocked {
+		fmt.Fprintf(&w, "\n\t%s", g)
+	}
+	return string(w.Bytes())
+}
+
+// OnDeadlock installs a handler that is invoked when the virtual runtime detects
+// a deadlock. If the handler returns, the runtime keeps waiting for an outside
+// event to unblock a goroutine. A nil handler restores the default one.
+//
+// The default handler prints the deadlock report to standard error and exits with
+// status 2, the way the Go runtime does. A test that runs a virtualized program
+// may instead hand the report over to the test goroutine and fail there:
+//
+//	deadlock := make(chan *vtime.Deadlock, 1)
+//	vtime.OnDeadlock(func(d *vtime.Deadlock) { deadlock <- d })
+//	...
+//	select {
+//	case d := <-deadlock:
+//		t.Fatal(d)
+//	case <-done:
+//	}
+func OnDeadlock(handler func(*Deadlock)) {
+	current().OnDeadlock(handler)
+}
+
+// OnDeadlock installs the deadlock handler of the scheduler. See OnDeadlock.
+func (s *Scheduler) OnDeadlock(handler func(*Deadlock)) {
+	if handler == nil {
+		handler = exitOnDeadlock
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ondeadlock = handler
+}
+
+func exitOnDeadlock(d *Deadlock) {
+	fmt.Fprintf(os.Stderr, "%s\n", d)
+	os.Exit(2)
+}
+
+// deadlockGrace is the real time for which the scheduler waits in a deadlocked state
+// before reporting it. It allows goroutines outside of the virtualized source, like
+// those serving network connections, to unblock virtualized goroutines.
+const deadlockGrace = time.Second
+
+// deadlock reports a deadlock, if the state of the scheduler is still at the
+// given version, at which all goroutines were blocked and the queue was empty
+func (s *Scheduler) deadlock(version uint64) {
+	s.mu.Lock()
+	if s.version.Load() != version {
+		s.mu.Unlock()
+		return
+	}
+	d := &Deadlock{
+		Now:     s.timeAt(s.now),
+		Elapsed: time.Duration(s.now),
+	}
+	handler := s.ondeadlock
+	s.mu.Unlock()
+	for _, g := range s.blockedGoroutines() {
+		if !g.Sleeping {
+			d.Blocked = append(d.Blocked, g)
+		}
+	}
+	handler(d)
+}
+
+// vtimePrefix is the prefix of the names of the functions in this package
+var vtimePrefix = reflect.TypeOf(Deadlock{}).PkgPath() + "."
+
+// blockedGoroutines lists the goroutines of the scheduler that the Go runtime
+// reports as blocked in channel operations, including the sleeping ones, except
+// for those of the virtual runtime. The position of each goroutine is that of the
+// innermost call outside of the Go runtime and the virtual runtime, not counting
+// the tests of the latter.
+func (s *Scheduler) blockedGoroutines() []BlockedGoroutine {
+	var r []BlockedGoroutine
+	for _, dump := range goroutineStacks() {
+		if g, ok := parseBlockedGoroutine(dump); ok && s.owns(g.ID) {
+			g.Name = nameOf(g.ID)
+			r = append(r, g)
+		}
+	}
+	sort.Slice(r, func(i, j int) bool {
+		return r[i].ID < r[j].ID
+	})
+	return r
+}
+
+// goroutineStacks returns the stack dumps of all goroutines
+func goroutineStacks() []string {
+	buf := make([]byte, 1<<16)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) {
+			return strings.Split(string(buf[:n]), "\n\n")
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+}
+
+// sleepFunc is the stack dump line of a call to sleep
+var sleepFunc = vtimePrefix + "(*Scheduler).sleep("
+
+// parseBlockedGoroutine parses the stack dump of a goroutine, which looks like
+//
+//	goroutine 7 [chan receive]:
+//	main.main.func1()
+//		/tmp/main.go:10 +0x2c
+//	created by main.main in goroutine 1
+//		/tmp/main.go:8 +0x58
+func parseBlockedGoroutine(dump string) (g BlockedGoroutine, ok bool) {
+	lines := strings.Split(dump, "\n")
+	header, found := strings.CutPrefix(lines[0], "goroutine ")
+	if !found {
+		return g, false
+	}
+	id, state, found := strings.Cut(header, " [")
+	if !found {
+		return g, false
+	}
+	if !strings.HasPrefix(state, "chan ") && !strings.HasPrefix(state, "select") {
+		return g, false
+	}
+	var err error
+	if g.ID, err = strconv.ParseInt(id, 10, 64); err != nil {
+		return g, false
+	}
+	for i := 1; i+1 < len(lines); i += 2 {
+		fn := lines[i]
+		if creator, found := strings.CutPrefix(fn, "created by "); found {
+			if _, parent, found := strings.Cut(creator, " in goroutine "); found {
+				g.Parent, _ = strconv.ParseInt(parent, 10, 64)
+			}
+			g.SpawnFile, g.SpawnLine = parsePos(lines[i+1])
+			break
+		}
+		if strings.HasPrefix(fn, sleepFunc) {
+			g.Sleeping = true
+		}
+		if g.File != "" || strings.HasPrefix(fn, "runtime.") {
+			continue
+		}
+		file, line := parsePos(lines[i+1])
+		if strings.HasPrefix(fn, vtimePrefix) && !strings.HasSuffix(file, "_test.go") {
+			continue
+		}
+		g.File, g.Line = file, line
+	}
+	return g, g.File != ""
+}
+
+// parsePos parses the position line of a stack frame, like "	/tmp/main.go:10 +0x2c"
+func parsePos(line string) (file string, n int) {
+	pos, _, _ := strings.Cut(strings.TrimSpace(line), " +0x")
+	colon := strings.LastIndexByte(pos, ':')
+	if colon < 0 {
+		return "", 0
+	}
+	n, _ = strconv.Atoi(pos[colon+1:])
+	return pos[:colon], n
+}
@@ -0,0 +1,91 @@
+// Copyright 2012 Petar Maymounkov. All rights reserved.
+// Use of this source code is governed by a 
+// license that can be found in the LICENSE file.
+
+package vtime
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+// defaultEpoch returns the Unix epoch in the local time zone, unless configured
+// otherwise by the environment. VTIME_EPOCH holds an RFC 3339 time and
+// VTIME_LOCATION holds a location name, as understood by time.LoadLocation.
+func defaultEpoch() time.Time {
+	loc := time.Local
+	if name := os.Getenv("VTIME_LOCATION"); name != "" {
+		var err error
+		if loc, err = time.LoadLocation(name); err != nil {
+			panic(fmt.Sprintf("invalid VTIME_LOCATION (%s)", err))
+		}
+	}
+	t := time.Unix(0, 0)
+	if value := os.Getenv("VTIME_EPOCH"); value != "" {
+		var err error
+		if t, err = time.Parse(time.RFC3339Nano, value); err != nil {
+			panic(fmt.Sprintf("invalid VTIME_EPOCH (%s)", err))
+		}
+	}
+	return makeEpoch(t, loc)
+}
+
+// makeEpoch returns the instant t in location loc, for use as the time.Time
+// corresponding to virtual time zero. The epoch is derived from a reading of
+// the real clock, so that it carries a monotonic clock reading, and then moved
+// to the desired instant. The times returned by Now are offsets from the epoch
+// and, just like the times returned by time.Now, their differences and
+// comparisons are computed from their monotonic readings, which are in virtual
+// time. The time package drops the monotonic reading of times past the year
+// 2157 and of times outside the local time zone, in which case the wall-clock
+// readings, which are virtual as well, are used instead. An instant farther
+// from the present than a time.Duration spans, about 292 years, cannot be
+// reached from the real clock and has no monotonic reading either.
+func makeEpoch(t time.Time, loc *time.Location) time.Time {
+	t = t.Round(0)
+	base := time.Now()
+	e := base.Add(t.Sub(base))
+	if !e.Equal(t) {
+		return t.In(loc)
+	}
+	if loc != time.Local {
+		e = e.In(loc)
+	}
+	return e
+}
+
+// timeAt converts a virtual time in nanoseconds to a time.Time
+func (s *Scheduler) timeAt(nsec int64) time.Time {
+	return s.epoch.Add(time.Duration(nsec))
+}
+
+// SetEpoch sets the wall-clock instant of virtual time zero. Changing the epoch
+// shifts the times reported by the virtual clock but has no effect on the timing
+// of sleeps and timers. Times read before and after the call are not comparable,
+// so SetEpoch is best called before the virtualized program starts reading the clock.
+func SetEpoch(t time.Time) {
+	current().SetEpoch(t)
+}
+
+// SetEpoch sets the epoch of the scheduler's virtual clock. See SetEpoch.
+func (s *Scheduler) SetEpoch(t time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.epoch = makeEpoch(t, s.epoch.Location())
+}
+
+// SetLocation sets the time zone of the times reported by the virtual clock
+func SetLocation(loc *time.Location) {
+	current().SetLocation(loc)
+}
+
+// SetLocation sets the time zone of the scheduler's virtual clock. See SetLocation.
+func (s *Scheduler) SetLocation(loc *time.Location) {
+	if loc == nil {
+		panic("nil location")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.epoch = makeEpoch(s.epoch, loc)
+}
@@ -0,0 +1,267 @@
+// Copyright 2012 Petar Maymounkov. All rights reserved.
+// Use of this source code is governed by a 
+// license that can be found in the LICENSE file.
+
+package vtime
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Goroutine is handed by Go from a spawning goroutine to the goroutine it spawns,
+// so that the latter runs on the scheduler of the former
+type Goroutine struct {
+	s      *Scheduler
+	parent int64 // Runtime ID of the spawning goroutine, recorded for observers
+	id     int64 // Runtime ID of the spawned goroutine, if known
+}
+
+/*
+	Go is invoked before go statements in the virtualized source.
+	In particular, the virtualizing compiler rewrites go statements like so:
+
+	Original:
+
+		go FuncName()
+
+	Virtualized:
+
+		go func(__vtime0 *vtime.Goroutine) {
+			__vtime0.Start()
+			defer __vtime0.Die()
+			FuncName()
+		}(vtime.Go())
+
+	Die is deferred, so that the exit of the goroutine is accounted for even if
+	FuncName panics or calls runtime.Goexit.
+*/
+func Go() *Goroutine {
+	s, id := lookup()
+	s.spawn()
+	g := &Goroutine{s: s}
+	if s.observed.Load() {
+		if id == 0 {
+			id = goid()
+		}
+		g.parent = id
+	}
+	return g
+}
+
+// Start is invoked first thing in goroutines spawned by virtualized go statements.
+// It binds the calling goroutine to the scheduler of its parent. Goroutines of the
+// standard scheduler need no binding, since the goroutine is new.
+func (g *Goroutine) Start() {
+	if g.s != std {
+		g.id = goid()
+		bound.Store(g.id, g.s)
+		nbound.Add(1)
+	}
+	g.s.started(g.parent)
+}
+
+// Die is deferred by goroutines spawned by virtualized go statements. See the doc
+// for Go. If the goroutine is panicking, Die reports the panic along with the
+// virtual time at which it occurred and then resumes panicking.
+func (g *Goroutine) Die() {
+	r := recover()
+	g.s.exit(r, g.id)
+	if r != nil {
+		panic(r)
+	}
+}
+
+// Die accounts for the exit of the calling goroutine, like Goroutine.Die
+func Die() {
+	r := recover()
+	s, id := lookup()
+	s.exit(r, id)
+	if r != nil {
+		panic(r)
+	}
+}
+
+// exit accounts for the exit of the calling goroutine, which is panicking with
+// the value r, unless r is nil. The runtime ID of the goroutine is id, or zero if
+// it is yet to be found.
+func (s *Scheduler) exit(r interface{}, id int64) {
+	if r != nil {
+		s.panicked(r)
+	}
+	s.die()
+	s.unbind(id)
+	forget(id)
+}
+
+// panicked reports that the calling goroutine panicked with the value r
+func (s *Scheduler) panicked(r interface{}) {
+	s.mu.Lock()
+	s.emit(EventPanic)
+	now, elapsed := s.timeAt(s.now), time.Duration(s.now)
+	s.mu.Unlock()
+	id := goid()
+	name := ""
+	if n := nameOf(id); n != "" {
+		name = " (" + n + ")"
+	}
+	fmt.Fprintf(os.Stderr, "vtime: goroutine %d%s panicked at virtual time %s (%s since epoch): %v\n",
+		id, name, now.Format(time.RFC3339Nano), elapsed, r)
+}
+
+// Goroutines are identified by the IDs that the Go runtime assigns to them. Deadlock
+// and leak reports find the parent and the spawn site of a goroutine in the stack
+// dump of the runtime, so they do not have to be recorded along the way. The only
+// bookkeeping is that of goroutine names.
+var (
+	names  sync.Map     // Goroutine ID -> name
+	nnamed atomic.Int64 // Number of named goroutines
+)
+
+// Name names the calling goroutine, e.g. vtime.Name("controller"). The name appears
+// in deadlock and leak reports and in the events seen by observers, including traces.
+func Name(name string) {
+	id := goid()
+	if _, loaded := names.Swap(id, name); !loaded {
+		nnamed.Add(1)
+	}
+	s := current()
+	if !s.observed.Load() {
+		return
+	}
+	s.mu.Lock()
+	s.emit(EventName)
+	s.mu.Unlock()
+}
+
+// nameOf returns the name of the goroutine with the given ID, if it has one
+func nameOf(id int64) string {
+	if nnamed.Load() == 0 {
+		return ""
+	}
+	if name, ok := names.Load(id); ok {
+		return name.(string)
+	}
+	return ""
+}
+
+// forget forgets the name of the calling goroutine, which is exiting, given its
+// runtime ID or zero
+func forget(id int64) {
+	if nnamed.Load() == 0 {
+		return
+	}
+	if id == 0 {
+		id = goid()
+	}
+	if _, ok := names.LoadAndDelete(id); ok {
+		nnamed.Add(-1)
+	}
+}
+
+// Goroutines are bound to schedulers other than the standard one by their
+// runtime IDs. As long as no goroutines are bound, which is the case for all
+// virtualized programs that do not use NewScheduler, finding the scheduler of
+// a goroutine costs nothing. Otherwise it costs a dump of the goroutine's stack,
+// see Scheduler.
+var (
+	bound  sync.Map     // Goroutine ID -> *Scheduler
+	nbound atomic.Int64 // Number of bound goroutines
+)
+
+// current returns the scheduler of the calling goroutine
+func current() *Scheduler {
+	s, _ := lookup()
+	return s
+}
+
+// lookup returns the scheduler of the calling goroutine along with its runtime ID,
+// which is zero unless it was needed to find the scheduler
+func lookup() (*Scheduler, int64) {
+	if nbound.Load() == 0 {
+		return std, 0
+	}
+	id := goid()
+	if s, ok := bound.Load(id); ok {
+		return s.(*Scheduler), id
+	}
+	return std, id
+}
+
+// bind binds the calling goroutine to the scheduler and returns a function that
+// restores the previous binding
+func (s *Scheduler) bind() (restore func()) {
+	if s == std && nbound.Load() == 0 {
+		return func() {}
+	}
+	id := goid()
+	prev, ok := bound.Load(id)
+	if s == std {
+		bound.Delete(id)
+	} else {
+		bound.Store(id, s)
+	}
+	adjustBound(ok, s != std)
+	return func() {
+		if ok {
+			bound.Store(id, prev)
+		} else {
+			bound.Delete(id)
+		}
+		adjustBound(s != std, ok)
+	}
+}
+
+// unbind removes the binding of the calling goroutine, which is exiting, given
+// its runtime ID or zero
+func (s *Scheduler) unbind(id int64) {
+	if s == std {
+		return
+	}
+	if id == 0 {
+		id = goid()
+	}
+	if _, ok := bound.LoadAndDelete(id); ok {
+		nbound.Add(-1)
+	}
+}
+
+// owns reports whether the goroutine with the given runtime ID belongs to the
+// scheduler, assuming that it belongs to some scheduler
+func (s *Scheduler) owns(id int64) bool {
+	if b, ok := bound.Load(id); ok {
+		return b.(*Scheduler) == s
+	}
+	return s == std
+}
+
+// adjustBound updates the number of bound goroutines after a goroutine was
+// bound or unbound
+func adjustBound(was, is bool) {
+	switch {
+	case !was && is:
+		nbound.Add(1)
+	case was && !is:
+		nbound.Add(-1)
+	}
+}
+
+// goid returns the runtime ID of the calling goroutine, which is the number in
+// the first line of its stack dump, "goroutine 7 [running]:"
+func goid() int64 {
+	var buf [64]byte
+	line := string(buf[:runtime.Stack(buf[:], false)])
+	line = strings.TrimPrefix(line, "goroutine ")
+	id, _, _ := strings.Cut(line, " ")
+	n, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		panic("cannot parse goroutine ID")
+	}
+	return n
+}
@@ -0,0 +1,155 @@
+// Copyright 2012 Petar Maymounkov. All rights reserved.
+// Use of this source code is governed by a 
+// license that can be found in the LICENSE file.
+
+package vtime
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+// Limit describes the state of a simulation that was stopped on reaching the limit
+// set by SetLimit
+type Limit struct {
+	Now     time.Time     // Virtual time at which the simulation stopped
+	Elapsed time.Duration // Virtual time elapsed since the epoch
+	Events  int64         // Number of sleeps, timers and breakpoints released
+}
+
+func (l *Limit) String() string {
+	return fmt.Sprintf("vtime: simulation stopped at virtual time %s (%s since epoch) after %d events",
+		l.Now.Format(time.RFC3339Nano), l.Elapsed, l.Events)
+}
+
+// limit holds the limit of a scheduler and the state of its shutdown. It is
+// guarded by the scheduler's lock.
+type limit struct {
+	elapsed  int64 // Virtual time limit since the epoch, or zero
+	events   int64 // Event count limit, or zero
+	stopped  bool
+	shutdown []func()
+	onlimit  func(*Limit)
+	done     chan struct{}
+}
+
+func (l *limit) init() {
+	l.onlimit = exitOnLimit
+	l.done = make(chan struct{})
+}
+
+func (l *limit) reset() {
+	if l.stopped {
+		l.stopped = false
+		l.done = make(chan struct{})
+	}
+}
+
+// SetLimit bounds the simulation on the scheduler of the calling goroutine.
+// See Scheduler.SetLimit.
+func SetLimit(elapsed time.Duration, events int64) {
+	current().SetLimit(elapsed, events)
+}
+
+// SetLimit bounds the simulation by the virtual time elapsed since the epoch and
+// by the number of events, i.e. sleeping goroutines, timers and breakpoints that
+// the scheduler releases. A zero bound is no bound. When the next event would
+// exceed a bound, the scheduler stops releasing sleepers and timers, which leaves
+// the goroutines of the program blocked. It then calls the shutdown hooks in the
+// reverse order of their registration, like deferred calls, and finally the limit
+// handler. Both are called on behalf of the scheduler, so they can read the
+// virtual clock, but they must not sleep.
+//
+// The vitamix command sets the limit of virtualized programs with its -limit and
+// -events flags.
+func (s *Scheduler) SetLimit(elapsed time.Duration, events int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.limit.elapsed, s.limit.events = int64(elapsed), events
+	s.changed()
+}
+
+// OnShutdown registers a hook, which the scheduler of the calling goroutine calls
+// when its simulation reaches its limit. See Scheduler.SetLimit.
+func OnShutdown(f func()) {
+	current().OnShutdown(f)
+}
+
+// OnShutdown registers a hook, which the scheduler calls when the simulation
+// reaches its limit
+func (s *Scheduler) OnShutdown(f func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.limit.shutdown = append(s.limit.shutdown, f)
+}
+
+// OnLimit installs a handler that is invoked, after the shutdown hooks, when the
+// simulation on the scheduler of the calling goroutine reaches its limit. A nil
+// handler restores the default one, which prints a summary to standard error and
+// exits with status 0.
+func OnLimit(handler func(*Limit)) {
+	current().OnLimit(handler)
+}
+
+// OnLimit installs the limit handler of the scheduler. See OnLimit.
+func (s *Scheduler) OnLimit(handler func(*Limit)) {
+	if handler == nil {
+		handler = exitOnLimit
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.limit.onlimit = handler
+}
+
+func exitOnLimit(l *Limit) {
+	fmt.Fprintf(os.Stderr, "%s\n", l)
+	os.Exit(0)
+}
+
+// Done returns a channel that is closed when the simulation on the scheduler has
+// reached its limit and the limit handler has returned. A test can thus run a
+// program that never returns for a bounded amount of virtual time:
+//
+//	s := vtime.NewScheduler()
+//	s.SetLimit(10*time.Minute, 0)
+//	s.OnLimit(func(l *vtime.Limit) { t.Log(l) })
+//	go s.Run(controller)
+//	<-s.Done()
+func (s *Scheduler) Done() <-chan struct{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.limit.done
+}
+
+// exceeds reports whether releasing an event at virtual time when would exceed the
+// limit. exceeds is called with the scheduler's lock held.
+func (s *Scheduler) exceeds(when int64) bool {
+	return s.limit.elapsed > 0 && when > s.limit.elapsed ||
+		s.limit.events > 0 && s.events >= s.limit.events
+}
+
+// stop stops the simulation on reaching its limit, before the event at virtual time
+// when. stop is called with the scheduler's lock held, which it releases before
+// calling the shutdown hooks and the limit handler.
+func (s *Scheduler) stop(when int64) {
+	if s.limit.elapsed > 0 && when > s.limit.elapsed && s.limit.elapsed > s.now {
+		s.now = s.limit.elapsed
+	}
+	s.limit.stopped = true
+	s.changed()
+	l := &Limit{
+		Now:     s.timeAt(s.now),
+		Elapsed: time.Duration(s.now),
+		Events:  s.events,
+	}
+	shutdown, handler, done := s.limit.shutdown, s.limit.onlimit, s.limit.done
+	s.mu.Unlock()
+
+	defer s.bind()()
+	for i := len(shutdown) - 1; i >= 0; i-- {
+		shutdown[i]()
+	}
+	handler(l)
+	close(done)
+}
@@ -0,0 +1,136 @@
+// Copyright 2012 Petar Maymounkov. All rights reserved.
+// Use of this source code is governed by a 
+// license that can be found in the LICENSE file.
+
+package vtime
+
+import (
+	"time"
+)
+
+// SetManual switches the scheduler of the calling goroutine to manual mode or
+// back. See Scheduler.SetManual.
+func SetManual(manual bool) {
+	current().SetManual(manual)
+}
+
+// SetManual switches the scheduler to manual mode or back to automatic mode.
+// In manual mode, the scheduler does not advance virtual time when all goroutines
+// are blocked. Sleeping goroutines and timers wait until virtual time is advanced
+// explicitly with Advance or AdvanceTo, like with a fake clock in a test:
+//
+//	s := vtime.NewScheduler()
+//	s.SetManual(true)
+//	s.Run(func() {
+//		go controller()
+//		s.Advance(3500 * time.Millisecond)
+//		// Check the state of the controller at 3.5s
+//	})
+//
+// The goroutine that advances time must not sleep itself, since there is no
+// one else to wake it up.
+func (s *Scheduler) SetManual(manual bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.manual = manual
+	s.changed()
+}
+
+// Advance advances the virtual clock of the calling goroutine's scheduler by d.
+// See Scheduler.Advance.
+func Advance(d time.Duration) {
+	current().Advance(d)
+}
+
+// AdvanceTo advances the virtual clock of the calling goroutine's scheduler to t.
+// See Scheduler.AdvanceTo.
+func AdvanceTo(t time.Time) {
+	current().AdvanceTo(t)
+}
+
+// Advance advances the virtual clock of the scheduler, which must be in manual
+// mode, by d. See AdvanceTo.
+func (s *Scheduler) Advance(d time.Duration) {
+	s.mu.Lock()
+	now := s.now
+	s.mu.Unlock()
+	s.advanceTo(now + int64(d))
+}
+
+// AdvanceTo advances the virtual clock of the scheduler, which must be in manual
+// mode, to t. The sleeping goroutines and timers due until t are released one
+// virtual instant after the other, in the same order as in automatic mode. Before
+// each release and before AdvanceTo returns, the scheduler waits for the goroutines
+// to block again, so that the caller observes the state of the program at t.
+// Breakpoints due until t are called by the goroutine calling AdvanceTo.
+// AdvanceTo has no effect if t is not after the current virtual time.
+func (s *Scheduler) AdvanceTo(t time.Time) {
+	s.mu.Lock()
+	nsec := int64(t.Sub(s.epoch))
+	s.mu.Unlock()
+	s.advanceTo(nsec)
+}
+
+func (s *Scheduler) advanceTo(nsec int64) {
+	self := 0
+	if current() == s {
+		self = 1
+	}
+	for {
+		s.quiesce(self)
+		s.mu.Lock()
+		if !s.manual {
+			s.mu.Unlock()
+			panic("advancing a scheduler in automatic mode")
+		}
+		if s.limit.stopped {
+			s.mu.Unlock()
+			return
+		}
+		min := s.q.Min()
+		when := nsec
+		if min != nil && min.when < nsec {
+			when = min.when
+		}
+		if s.exceeds(when) {
+			s.stop(when)
+			return
+		}
+		if min == nil || min.when > nsec {
+			if nsec > s.now {
+				s.now = nsec
+				s.changed()
+			}
+			s.mu.Unlock()
+			return
+		}
+		at := s.release(s.q.DeleteMin())
+		s.mu.Unlock()
+		if at != nil {
+			s.breakpoint(at)
+		}
+	}
+}
+
+// quiesce waits until all goroutines of the scheduler, except for self of them,
+// are blocked and the ones blocked in channel operations have settled
+func (s *Scheduler) quiesce(self int) {
+	s.mu.Lock()
+	for {
+		for s.nblock < s.ngo-self {
+			s.nwait++
+			s.quiet.Wait()
+			s.nwait--
+		}
+		if s.nblock == s.nsleep {
+			s.mu.Unlock()
+			return
+		}
+		version := s.version.Load()
+		s.mu.Unlock()
+		if s.settle(version) {
+			return
+		}
+		s.mu.Lock()
+	}
+}
@@ -0,0 +1,39 @@
+// Copyright 2012 Petar Maymounkov. All rights reserved.
+// Use of this source code is governed by a 
+// license that can be found in the LICENSE file.
+
+package vtime
+
+import (
+	"testing"
+	"time"
+)
+
+func TestManual(t *testing.T) {
+	s := NewScheduler()
+	s.SetManual(true)
+	s.Run(func() {
+		start := Now()
+		var ticks []time.Duration
+		g := Go()
+		go func() {
+			g.Start()
+			for i := 0; i < 3; i++ {
+				Sleep(time.Second)
+				ticks = append(ticks, Since(start))
+			}
+			g.Die()
+		}()
+		Advance(2500 * time.Millisecond)
+		if len(ticks) != 2 || ticks[1] != 2*time.Second {
+			t.Errorf("ticks %v at 2.5s", ticks)
+		}
+		if d := Since(start); d != 2500*time.Millisecond {
+			t.Errorf("clock at %v", d)
+		}
+		AdvanceTo(start.Add(time.Hour))
+		if len(ticks) != 3 || ticks[2] != 3*time.Second {
+			t.Errorf("ticks %v at 1h", ticks)
+		}
+	})
+}
@@ -0,0 +1,145 @@
+// Copyright 2012 Petar Maymounkov. All rights reserved.
+// Use of this source code is governed by a 
+// license that can be found in the LICENSE file.
+
+package vtime
+
+import (
+	"runtime"
+	"strings"
+	"time"
+)
+
+// EventKind is the kind of an event observed by an Observer
+type EventKind int
+
+const (
+	EventGo      EventKind = iota // A goroutine started
+	EventDie                      // A goroutine exited
+	EventBlock                    // A goroutine entered a blocking channel operation
+	EventUnblock                  // A goroutine completed a blocking channel operation
+	EventSleep                    // A goroutine went to sleep
+	EventWake                     // The scheduler woke up a sleeping goroutine
+	EventName                     // A goroutine named itself, see Name
+	EventPanic                    // A goroutine is exiting with a panic
+)
+
+var eventKindNames = []string{"go", "die", "block", "unblock", "sleep", "wake", "name", "panic"}
+
+func (k EventKind) String() string {
+	if k < 0 || int(k) >= len(eventKindNames) {
+		return "unknown"
+	}
+	return eventKindNames[k]
+}
+
+// Event is an event in the life of a goroutine of the virtualized program
+type Event struct {
+	Kind      EventKind
+	Now       time.Time     // Virtual time of the event
+	Elapsed   time.Duration // Virtual time elapsed since the epoch
+	Goroutine int64         // Goroutine identifier assigned by the Go runtime
+	Name      string        // Name of the goroutine, if any
+	Parent    int64         // For EventGo, the goroutine that spawned it, if known
+	File      string        // Position of the event in the virtualized source
+	Line      int
+}
+
+// Observer receives the events of the goroutines of a scheduler. Observe is called
+// in the order of the events, with the scheduler's lock held, so it must not call
+// into the scheduler, e.g. by reading the virtual clock.
+type Observer interface {
+	Observe(Event)
+}
+
+// ObserverFunc adapts a function to the Observer interface
+type ObserverFunc func(Event)
+
+func (f ObserverFunc) Observe(e Event) {
+	f(e)
+}
+
+// Observe installs an observer on the scheduler of the calling goroutine.
+// See Scheduler.Observe.
+func Observe(o Observer) (stop func()) {
+	return current().Observe(o)
+}
+
+// Observe installs an observer, which receives all events on the scheduler until
+// the returned stop function is called. Goroutine identifiers and positions are
+// only collected while observers are installed.
+func (s *Scheduler) Observe(o Observer) (stop func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry := &observer{ o: o }
+	s.observers = append(s.observers, entry)
+	s.observed.Store(true)
+	return func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		for i, x := range s.observers {
+			if x == entry {
+				s.observers = append(s.observers[:i:i], s.observers[i+1:]...)
+				break
+			}
+		}
+		s.observed.Store(len(s.observers) > 0)
+	}
+}
+
+// observer is an installed Observer, which the stop function finds by identity
+type observer struct {
+	o Observer
+}
+
+// emit delivers an event of the calling goroutine to the observers and returns it,
+// or returns nil if there are no observers. emit is called with the scheduler's
+// lock held.
+func (s *Scheduler) emit(kind EventKind) *Event {
+	e := s.event(kind)
+	if e != nil {
+		s.notify(e)
+	}
+	return e
+}
+
+// event returns an event of the calling goroutine, or nil if there are no observers.
+// event is called with the scheduler's lock held.
+func (s *Scheduler) event(kind EventKind) *Event {
+	if len(s.observers) == 0 {
+		return nil
+	}
+	e := &Event{
+		Kind:      kind,
+		Goroutine: goid(),
+	}
+	e.Name = nameOf(e.Goroutine)
+	e.File, e.Line = callerPos()
+	return e
+}
+
+// notify stamps the event e with the current virtual time and delivers it to the
+// observers. notify is called with the scheduler's lock held.
+func (s *Scheduler) notify(e *Event) {
+	e.Now, e.Elapsed = s.timeAt(s.now), time.Duration(s.now)
+	for _, x := range s.observers {
+		x.o.Observe(*e)
+	}
+}
+
+// callerPos returns the position of the innermost call outside of this package,
+// not counting its tests, and outside of the Go runtime
+func callerPos() (file string, line int) {
+	var pcs [16]uintptr
+	frames := runtime.CallersFrames(pcs[:runtime.Callers(2, pcs[:])])
+	for {
+		frame, more := frames.Next()
+		internal := strings.HasPrefix(frame.Function, vtimePrefix) && !strings.HasSuffix(frame.File, "_test.go")
+		if !internal && !strings.HasPrefix(frame.Function, "runtime.") {
+			return frame.File, frame.Line
+		}
+		if !more {
+			return "", 0
+		}
+	}
+}
@@ -0,0 +1,113 @@
+// Copyright 2012 Petar Maymounkov. All rights reserved.
+// Use of this source code is governed by a 
+// license that can be found in the LICENSE file.
+
+package vtime
+
+import (
+	"container/heap"
+)
+
+// queue is a priority queue of until instances, ordered ascending by timestamp.
+// Entries with equal timestamps are ordered by insertion, first in first out,
+// so goroutines and timers due at the same virtual instant are released in the
+// order in which they went to sleep or were scheduled. Rescheduled tickers
+// count as newly inserted. Breakpoints precede all other entries with the same
+// timestamp. Add, Remove and DeleteMin take logarithmic time.
+type queue struct {
+	heap untilHeap
+	seq  int64
+}
+
+// until is a queue entry. It either wakes a sleeping goroutine, fires a timer or
+// calls a breakpoint.
+type until struct {
+	when  int64
+	wake  chan struct{}
+	sleep *Event // Observed sleep event of the goroutine to wake
+	timer *Timer
+	at    func() // Breakpoint callback, see At
+	seq   int64  // Order of insertion
+	index int    // Position in the heap, or -1 if not in the queue
+}
+
+func makeUntil(duration, now int64) *until {
+	if duration < 0 {
+		duration = 0
+	}
+	return &until{
+		when:  now + duration,
+		index: -1,
+	}
+}
+
+func (t *queue) Len() int {
+	return len(t.heap)
+}
+
+func (t *queue) Add(u *until) {
+	u.seq = t.seq
+	t.seq++
+	heap.Push(&t.heap, u)
+}
+
+// Remove removes the entry u from the queue, if present
+func (t *queue) Remove(u *until) {
+	if u.index < 0 {
+		return
+	}
+	heap.Remove(&t.heap, u.index)
+}
+
+// Min returns the first entry of the queue, without removing it
+func (t *queue) Min() *until {
+	if len(t.heap) == 0 {
+		return nil
+	}
+	return t.heap[0]
+}
+
+func (t *queue) DeleteMin() *until {
+	if len(t.heap) == 0 {
+		return nil
+	}
+	return heap.Pop(&t.heap).(*until)
+}
+
+// untilHeap implements heap.Interface
+type untilHeap []*until
+
+func (h untilHeap) Len() int {
+	return len(h)
+}
+
+func (h untilHeap) Less(i, j int) bool {
+	if h[i].when != h[j].when {
+		return h[i].when < h[j].when
+	}
+	if bi, bj := h[i].at != nil, h[j].at != nil; bi != bj {
+		return bi
+	}
+	return h[i].seq < h[j].seq
+}
+
+func (h untilHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *untilHeap) Push(x interface{}) {
+	u := x.(*until)
+	u.index = len(*h)
+	*h = append(*h, u)
+}
+
+func (h *untilHeap) Pop() interface{} {
+	old := *h
+	u := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	u.index = -1
+	return u
+}
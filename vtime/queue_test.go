@@ -0,0 +1,34 @@
+// Copyright 2012 Petar Maymounkov. All rights reserved.
+// Use of this source code is governed by a 
+// license that can be found in the LICENSE file.
+
+package vtime
+
+import (
+	"testing"
+)
+
+func TestQueueOrder(t *testing.T) {
+	var q queue
+	var us []*until
+	for i, when := range []int64{ 3, 1, 2, 1, 3, 1 } {
+		u := makeUntil(when, 0)
+		u.wake = make(chan struct{})
+		us = append(us, u)
+		q.Add(u)
+		if i == 4 {
+			// Entries removed from the middle of the queue are not released
+			q.Remove(us[1])
+		}
+	}
+	exp := []*until{ us[3], us[5], us[2], us[0], us[4] }
+	for i, e := range exp {
+		u := q.DeleteMin()
+		if u != e {
+			t.Fatalf("entry %d: expected time %d seq %d, got time %d seq %d", i, e.when, e.seq, u.when, u.seq)
+		}
+	}
+	if q.DeleteMin() != nil || q.Len() != 0 {
+		t.Errorf("expected empty queue")
+	}
+}
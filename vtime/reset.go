@@ -0,0 +1,135 @@
+// Copyright 2012 Petar Maymounkov. All rights reserved.
+// Use of this source code is governed by a 
+// license that can be found in the LICENSE file.
+
+package vtime
+
+import (
+	"bytes"
+	"fmt"
+	"time"
+)
+
+// Leak describes goroutines of the virtualized program that are still active
+// when their scheduler is reset
+type Leak struct {
+	Now        time.Time          // Virtual time at which the scheduler was to be reset
+	Running    int                // Number of leaked goroutines that are not blocked
+	Blocked    int                // Number of leaked goroutines that are blocked
+	Goroutines []BlockedGoroutine // Blocked and sleeping leaked goroutines, ordered by ID
+}
+
+func (l *Leak) Error() string {
+	var w bytes.Buffer
+	fmt.Fprintf(&w, "vtime: %d running and %d blocked goroutines leaked at virtual time %s",
+		l.Running, l.Blocked, l.Now.Format(time.RFC3339Nano))
+	for _, g := range l.Goroutines {
+		fmt.Fprintf(&w, "\n\t%s", g)
+	}
+	return string(w.Bytes())
+}
+
+// Reset resets the virtual clock of the calling goroutine's scheduler. See Scheduler.Reset.
+func Reset() error {
+	return current().Reset()
+}
+
+// Reset turns the virtual clock of the scheduler back to its epoch, stops all
+// timers and tickers and drops all breakpoints. The scheduler must be quiescent:
+// other than the calling goroutine, if it belongs to the scheduler, no goroutines
+// may be active. Reset waits for exiting goroutines to finish, and for running
+// goroutines to block for up to resetTimeout of real time. If goroutines remain,
+// Reset returns a *Leak and leaves the scheduler as it is. The epoch, the location,
+// the limit and the handlers are kept, and a simulation stopped at its limit may
+// run again.
+func (s *Scheduler) Reset() error {
+	self := 0
+	if current() == s {
+		self = 1
+	}
+	deadline := time.Now().Add(resetTimeout)
+	for {
+		s.mu.Lock()
+		if s.ngo == self && s.nblock == 0 {
+			s.reset()
+			s.mu.Unlock()
+			return nil
+		}
+		version := s.version.Load()
+		s.mu.Unlock()
+		if !s.settle(version) {
+			continue
+		}
+		// An exiting goroutine may appear idle to settle, while it has yet to die
+		s.mu.Lock()
+		running := s.ngo - s.nblock - self
+		if running > 0 && time.Now().Before(deadline) || s.ngo == self && s.nblock == 0 {
+			s.mu.Unlock()
+			continue
+		}
+		l := &Leak{
+			Now:     s.timeAt(s.now),
+			Running: running,
+			Blocked: s.nblock,
+		}
+		s.mu.Unlock()
+		l.Goroutines = s.blockedGoroutines()
+		return l
+	}
+}
+
+// resetTimeout bounds the real time for which Reset waits for running goroutines
+// of the scheduler to block or exit
+const resetTimeout = time.Second
+
+// reset is called with the scheduler's lock held, when it has no goroutines
+// other than the caller's
+func (s *Scheduler) reset() {
+	for u := s.q.DeleteMin(); u != nil; u = s.q.DeleteMin() {
+		if u.timer != nil {
+			u.timer.pending = nil
+		}
+	}
+	s.now = 0
+	s.events = 0
+	s.limit.reset()
+	s.changed()
+}
+
+// TB is the part of testing.TB used by Test
+type TB interface {
+	Helper()
+	Cleanup(func())
+	Error(args ...interface{})
+}
+
+// Test gives the test t a fresh timeline on the scheduler of the calling goroutine.
+// See Scheduler.Test.
+func Test(t TB) {
+	t.Helper()
+	current().Test(t)
+}
+
+// Test resets the scheduler before the test t and once more after it, when t
+// has completed. Goroutines that the test leaks are reported as test errors.
+// Parallel tests should each use a scheduler of their own:
+//
+//	func TestController(t *testing.T) {
+//		t.Parallel()
+//		s := vtime.NewScheduler()
+//		s.Test(t)
+//		s.Run(func() {
+//			...
+//		})
+//	}
+func (s *Scheduler) Test(t TB) {
+	t.Helper()
+	if err := s.Reset(); err != nil {
+		t.Error(err)
+	}
+	t.Cleanup(func() {
+		if err := s.Reset(); err != nil {
+			t.Error(err)
+		}
+	})
+}
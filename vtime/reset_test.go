@@ -0,0 +1,75 @@
+// Copyright 2012 Petar Maymounkov. All rights reserved.
+// Use of this source code is governed by a 
+// license that can be found in the LICENSE file.
+
+package vtime
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReset(t *testing.T) {
+	s := NewScheduler()
+	s.Test(t)
+	s.Run(func() {
+		start := Now()
+		AfterFunc(time.Minute, func() {
+			t.Error("stopped timer fired")
+		})
+		Sleep(time.Second)
+		if err := Reset(); err != nil {
+			t.Fatal(err)
+		}
+		if now := Now(); !now.Equal(start) {
+			t.Errorf("clock reset to %v, expecting %v", now, start)
+		}
+		Sleep(2 * time.Minute)
+	})
+}
+
+// leakTB records the errors reported by Scheduler.Test
+type leakTB struct {
+	testing.TB
+	errs    []interface{}
+	cleanup func()
+}
+
+func (t *leakTB) Cleanup(f func()) {
+	t.cleanup = f
+}
+
+func (t *leakTB) Error(args ...interface{}) {
+	t.errs = append(t.errs, args...)
+}
+
+func TestResetLeak(t *testing.T) {
+	s := NewScheduler()
+	s.OnDeadlock(func(*Deadlock) {})
+	tb := &leakTB{ TB: t }
+	s.Test(tb)
+	s.Run(func() {
+		stuck := make(chan int)
+		g := Go()
+		go func() {
+			g.Start()
+			Name("stuck")
+			Block()
+			<-stuck
+			Unblock()
+			g.Die()
+		}()
+	})
+	tb.cleanup()
+	if len(tb.errs) != 1 {
+		t.Fatalf("expecting one error, got %v", tb.errs)
+	}
+	l, ok := tb.errs[0].(*Leak)
+	if !ok || l.Blocked != 1 || l.Running != 0 || len(l.Goroutines) != 1 {
+		t.Fatalf("expecting one blocked goroutine, got %v", tb.errs[0])
+	}
+	if g := l.Goroutines[0]; g.Name != "stuck" || g.Parent == 0 || !strings.HasSuffix(g.File, "reset_test.go") {
+		t.Errorf("leaked %v", g)
+	}
+}
@@ -0,0 +1,69 @@
+// Copyright 2012 Petar Maymounkov. All rights reserved.
+// Use of this source code is governed by a 
+// license that can be found in the LICENSE file.
+
+package vtime
+
+import (
+	"time"
+)
+
+// Ticker is the virtualized version of time.Ticker. Ticks are delivered on C
+// at the virtual times of the ticks. As with time.Ticker, ticks are dropped
+// for receivers that fall behind.
+type Ticker struct {
+	C <-chan time.Time
+	t *Timer
+}
+
+// NewTicker is the virtualized version of time.NewTicker
+func NewTicker(d time.Duration) *Ticker {
+	return current().NewTicker(d)
+}
+
+// NewTicker creates a ticker on the virtual clock of the scheduler. See NewTicker.
+func (s *Scheduler) NewTicker(d time.Duration) *Ticker {
+	if d <= 0 {
+		panic("non-positive interval for NewTicker")
+	}
+	c := make(chan time.Time, 1)
+	t := &Ticker{
+		C: c,
+		t: &Timer{
+			C: c,
+			c: c,
+			s: s,
+		},
+	}
+	t.t.resetPeriod(int64(d), int64(d))
+	return t
+}
+
+// Tick is the virtualized version of time.Tick
+func Tick(d time.Duration) <-chan time.Time {
+	if d <= 0 {
+		return nil
+	}
+	return NewTicker(d).C
+}
+
+// Tick is like NewTicker, but it only returns the ticker's channel. See Tick.
+func (s *Scheduler) Tick(d time.Duration) <-chan time.Time {
+	if d <= 0 {
+		return nil
+	}
+	return s.NewTicker(d).C
+}
+
+// Stop is the virtualized version of time.Ticker.Stop
+func (t *Ticker) Stop() {
+	t.t.Stop()
+}
+
+// Reset is the virtualized version of time.Ticker.Reset
+func (t *Ticker) Reset(d time.Duration) {
+	if d <= 0 {
+		panic("non-positive interval for Ticker.Reset")
+	}
+	t.t.resetPeriod(int64(d), int64(d))
+}
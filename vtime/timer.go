@@ -0,0 +1,156 @@
+// Copyright 2012 Petar Maymounkov. All rights reserved.
+// Use of this source code is governed by a 
+// license that can be found in the LICENSE file.
+
+package vtime
+
+import (
+	"time"
+)
+
+// Timer is the virtualized version of time.Timer. When the timer expires,
+// the virtual time of expiry is sent on C, unless the timer was created by
+// AfterFunc.
+type Timer struct {
+	C <-chan time.Time
+	c chan time.Time
+	f func()
+	s *Scheduler
+
+	// pending is the queue entry of an active timer and period is the
+	// interval at which a ticker is rescheduled. Both are guarded by the
+	// scheduler's lock.
+	pending *until
+	period  int64
+}
+
+// NewTimer is the virtualized version of time.NewTimer
+func NewTimer(d time.Duration) *Timer {
+	return current().NewTimer(d)
+}
+
+// NewTimer creates a timer on the virtual clock of the scheduler. See NewTimer.
+func (s *Scheduler) NewTimer(d time.Duration) *Timer {
+	c := make(chan time.Time, 1)
+	t := &Timer{
+		C: c,
+		c: c,
+		s: s,
+	}
+	t.Reset(d)
+	return t
+}
+
+// AfterFunc is the virtualized version of time.AfterFunc. The function f is
+// called in its own goroutine, which is accounted for as if it were started
+// by a virtualized go statement.
+func AfterFunc(d time.Duration, f func()) *Timer {
+	return current().AfterFunc(d, f)
+}
+
+// AfterFunc calls f in its own goroutine of the scheduler, once d has elapsed
+// on its virtual clock. See AfterFunc.
+func (s *Scheduler) AfterFunc(d time.Duration, f func()) *Timer {
+	t := &Timer{
+		f: f,
+		s: s,
+	}
+	t.Reset(d)
+	return t
+}
+
+// Stop is the virtualized version of time.Timer.Stop. As with the Go 1.23
+// timers, no stale value is received from C after Stop returns.
+func (t *Timer) Stop() bool {
+	t.s.mu.Lock()
+	defer t.s.mu.Unlock()
+	active := t.stop()
+	t.s.changed()
+	return active
+}
+
+// Reset is the virtualized version of time.Timer.Reset. As with the Go 1.23
+// timers, no stale value is received from C after Reset returns.
+func (t *Timer) Reset(d time.Duration) bool {
+	return t.resetPeriod(int64(d), 0)
+}
+
+// resetPeriod schedules the timer to fire after duration and then every
+// period nanoseconds, if period is positive
+func (t *Timer) resetPeriod(duration, period int64) bool {
+	t.s.mu.Lock()
+	defer t.s.mu.Unlock()
+	active := t.reset(duration, period)
+	t.s.changed()
+	return active
+}
+
+// stop removes the timer from the queue and drains its channel. It reports
+// whether the timer was active. stop is called with the scheduler's lock held.
+func (t *Timer) stop() bool {
+	if t.c != nil {
+		select {
+		case <-t.c:
+		default:
+		}
+	}
+	if t.pending == nil {
+		return false
+	}
+	t.s.q.Remove(t.pending)
+	t.pending = nil
+	return true
+}
+
+// reset stops the timer and schedules it anew. It reports whether the timer
+// was active. reset is called with the scheduler's lock held.
+func (t *Timer) reset(duration, period int64) bool {
+	active := t.stop()
+	t.period = period
+	t.schedule(duration)
+	return active
+}
+
+func (t *Timer) schedule(duration int64) {
+	t.pending = makeUntil(duration, t.s.now)
+	t.pending.timer = t
+	t.s.q.Add(t.pending)
+}
+
+// fire delivers the expiry of the timer at the current virtual time and
+// reschedules tickers. fire is called by the loop, with the scheduler's
+// lock held.
+func (t *Timer) fire() {
+	s := t.s
+	t.pending = nil
+	if t.period > 0 {
+		t.schedule(t.period)
+	}
+	if t.f != nil {
+		s.ngo++
+		g := &Goroutine{s: s}
+		go func() {
+			g.Start()
+			defer g.Die()
+			t.f()
+		}()
+		return
+	}
+	// As with the time package, the value is dropped if the receiver
+	// has not picked up the previous one
+	select {
+	case t.c <- s.timeAt(s.now):
+	default:
+	}
+}
+
+// After is the virtualized version of time.After
+func After(d time.Duration) <-chan time.Time {
+	return NewTimer(d).C
+}
+
+// After waits for d to elapse on the virtual clock of the scheduler and then
+// sends the virtual time on the returned channel. See After.
+func (s *Scheduler) After(d time.Duration) <-chan time.Time {
+	return s.NewTimer(d).C
+}
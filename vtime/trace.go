@@ -0,0 +1,149 @@
+// Copyright 2012 Petar Maymounkov. All rights reserved.
+// Use of this source code is governed by a 
+// license that can be found in the LICENSE file.
+
+package vtime
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Trace is an Observer that writes the events of a scheduler in the JSON array
+// format of the Chrome Trace Event format, which trace viewers like Perfetto and
+// chrome://tracing display. Each goroutine is a track, on which sleeps and blocking
+// channel operations are shown as intervals and starts and exits as instants, all
+// on the virtual timeline. Tracks are labeled with the names given by Name.
+// Setting the environment variable VTIME_TRACE to a file name makes virtualized
+// programs write such a trace of the standard scheduler:
+//
+//	VTIME_TRACE=trace.json ./program
+//
+// The trace is written while the program runs. The closing bracket of the array,
+// which trace viewers do not require, is written by Close, or on reaching the
+// limit of the simulation in the case of VTIME_TRACE.
+type Trace struct {
+	w     io.Writer
+	n     int            // Number of events written
+	named map[int64]bool // Goroutines whose tracks have been named
+	err   error
+}
+
+// NewTrace returns a trace that writes to w
+func NewTrace(w io.Writer) *Trace {
+	return &Trace{
+		w:     w,
+		named: make(map[int64]bool),
+	}
+}
+
+// traceEvent is an event in the Chrome Trace Event format
+type traceEvent struct {
+	Name  string            `json:"name"`
+	Phase string            `json:"ph"`
+	Scope string            `json:"s,omitempty"`
+	TS    float64           `json:"ts"` // Microseconds
+	PID   int               `json:"pid"`
+	TID   int64             `json:"tid"`
+	Args  map[string]string `json:"args,omitempty"`
+}
+
+// Observe writes the event e to the trace
+func (t *Trace) Observe(e Event) {
+	if !t.named[e.Goroutine] || e.Kind == EventName {
+		t.named[e.Goroutine] = true
+		name := fmt.Sprintf("goroutine %d", e.Goroutine)
+		if e.Name != "" {
+			name = fmt.Sprintf("%s (goroutine %d)", e.Name, e.Goroutine)
+		}
+		t.write(&traceEvent{
+			Name:  "thread_name",
+			Phase: "M",
+			PID:   1,
+			TID:   e.Goroutine,
+			Args:  map[string]string{ "name": name },
+		})
+	}
+	te := &traceEvent{
+		TS:   float64(e.Elapsed.Nanoseconds()) / 1e3,
+		PID:  1,
+		TID:  e.Goroutine,
+		Args: map[string]string{},
+	}
+	if e.File != "" {
+		te.Args["pos"] = fmt.Sprintf("%s:%d", e.File, e.Line)
+	}
+	switch e.Kind {
+	case EventGo:
+		te.Name, te.Phase, te.Scope = "go", "i", "t"
+		if e.Parent != 0 {
+			te.Args["parent"] = fmt.Sprintf("goroutine %d", e.Parent)
+		}
+	case EventDie, EventPanic:
+		te.Name, te.Phase, te.Scope = e.Kind.String(), "i", "t"
+	case EventBlock:
+		te.Name, te.Phase = "blocked", "B"
+	case EventUnblock:
+		te.Name, te.Phase = "blocked", "E"
+	case EventSleep:
+		te.Name, te.Phase = "sleep", "B"
+	case EventWake:
+		te.Name, te.Phase = "sleep", "E"
+	default:
+		return
+	}
+	t.write(te)
+}
+
+func (t *Trace) write(te *traceEvent) {
+	if t.err != nil {
+		return
+	}
+	buf, err := json.Marshal(te)
+	if err != nil {
+		t.err = err
+		return
+	}
+	if t.n == 0 {
+		buf = append([]byte("[\n"), buf...)
+	} else {
+		buf = append([]byte(",\n"), buf...)
+	}
+	t.n++
+	_, t.err = t.w.Write(buf)
+}
+
+// Close completes the JSON array of the trace. It returns the first error that
+// occurred while writing the trace. Close does not close the underlying writer.
+func (t *Trace) Close() error {
+	if t.err != nil {
+		return t.err
+	}
+	if t.n == 0 {
+		_, t.err = io.WriteString(t.w, "[")
+	}
+	if t.err == nil {
+		_, t.err = io.WriteString(t.w, "\n]\n")
+	}
+	return t.err
+}
+
+// traceFromEnv installs a trace on the scheduler, if VTIME_TRACE names a file
+func traceFromEnv(s *Scheduler) {
+	name := os.Getenv("VTIME_TRACE")
+	if name == "" {
+		return
+	}
+	f, err := os.Create(name)
+	if err != nil {
+		panic(fmt.Sprintf("invalid VTIME_TRACE (%s)", err))
+	}
+	t := NewTrace(f)
+	s.Observe(t)
+	s.OnShutdown(func() {
+		t.Close()
+		f.Close()
+	})
+}
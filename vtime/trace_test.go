@@ -0,0 +1,49 @@
+// Copyright 2012 Petar Maymounkov. All rights reserved.
+// Use of this source code is governed by a 
+// license that can be found in the LICENSE file.
+
+package vtime
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestTrace(t *testing.T) {
+	var buf bytes.Buffer
+	trace := NewTrace(&buf)
+	s := NewScheduler()
+	stop := s.Observe(trace)
+	s.Run(func() {
+		Sleep(time.Second)
+	})
+	stop()
+	if err := trace.Close(); err != nil {
+		t.Fatal(err)
+	}
+	var events []traceEvent
+	if err := json.Unmarshal(buf.Bytes(), &events); err != nil {
+		t.Fatalf("%v in trace %s", err, buf.String())
+	}
+	var got []string
+	for _, e := range events {
+		got = append(got, e.Name+" "+e.Phase)
+		if e.TID != events[0].TID {
+			t.Errorf("event %+v on another track", e)
+		}
+	}
+	want := []string{"thread_name M", "go i", "sleep B", "sleep E", "die i"}
+	if len(got) != len(want) {
+		t.Fatalf("events %v, expecting %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("events %v, expecting %v", got, want)
+		}
+	}
+	if ts := events[3].TS; ts != 1e6 {
+		t.Errorf("wake at %vµs", ts)
+	}
+}
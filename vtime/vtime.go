@@ -5,179 +5,358 @@
 package vtime
 
 import (
-	"sort"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 // Sleep is the virtualized version of time.Sleep
 func Sleep(nsec time.Duration) {
-	ch := make(chan struct{})
-	vch <- &vsleep{
-		duration: int64(nsec),
-		wake:     ch,
-	}
-	<-ch
-}
-
-type vsleep struct {
-	duration int64
-	wake     chan struct{}
+	current().Sleep(nsec)
 }
 
 // Now is the virtualized version of time.Now
 func Now() time.Time {
-	ch := make(chan int64)
-	vch <- &vnow{
-		resp: ch,
-	}
-	return time.Unix(0, <-ch)
+	return current().Now()
 }
 
-type vnow struct {
-	resp chan int64
+// Since is the virtualized version of time.Since
+func Since(t time.Time) time.Duration {
+	return Now().Sub(t)
 }
 
-/*
-	Go is invoked before go statements in the virtualized source.
-	In particular, the virtualizing compiler rewrites go statements like so:
+// Until is the virtualized version of time.Until
+func Until(t time.Time) time.Duration {
+	return t.Sub(Now())
+}
 
-	Original:
+// Block is invoked before every blocking channel operation (send, receive,
+// select statements) in the transformed source
+func Block() {
+	current().Block()
+}
 
-		go FuncName()
+// Unblock is invoked after every blocking channel operation (send, receive,
+// select statements) in the transformed source
+func Unblock() {
+	current().Unblock()
+}
 
-	Virtualized:
+// Runtime below
 
-		vtime.Go()
-		go func() {
-			FuncName()
-			vtime.Die()
-		}
-*/
-func Go() {
-	vch <- vgo{}
+// Scheduler is a virtual clock together with the goroutines of the virtualized
+// program that run on it. Goroutines update its state directly, under its lock.
+// When all of them are blocked, the scheduler's loop goroutine advances virtual
+// time to the next sleep call or timer in the queue.
+//
+// Virtualized programs run on the standard scheduler, which counts the main
+// goroutine as its first goroutine. Independent simulations in one process, like
+// parallel tests, create schedulers of their own with NewScheduler and call into
+// the virtualized code with Run.
+//
+// The package-level functions, which the virtualized source calls, find the
+// scheduler of the calling goroutine. While goroutines run on schedulers created
+// by NewScheduler, this takes a dump of the calling goroutine's stack, which costs
+// microseconds per call rather than nanoseconds, as BenchmarkNowScheduler shows.
+// Code that holds a Scheduler may call its methods, such as Now, Sleep, Block and
+// Unblock, which do without the lookup.
+type Scheduler struct {
+	mu         sync.Mutex
+	now        int64     // Current virtual time
+	ngo        int       // Number of active goroutines
+	nblock     int       // Number of blocked goroutines, including sleeping ones
+	nsleep     int       // Number of sleeping goroutines
+	q          queue     // Queue of waiting sleep calls, active timers and tickers
+	epoch      time.Time // See epoch.go
+	ondeadlock func(*Deadlock)
+	watched    uint64      // Version of the state last watched for a deadlock
+	manual     bool        // Whether time is advanced by Advance only, see manual.go
+	nwait      int         // Number of goroutines waiting on quiet
+	quiet      sync.Cond   // Signals changes of the state to waiting goroutines
+	events     int64       // Number of released queue entries
+	limit      limit       // See limit.go
+	observers  []*observer // See observe.go
+
+	version  atomic.Uint64 // Counts the changes of the state above
+	observed atomic.Bool   // Whether there are observers
+	kick     chan struct{} // Wakes up the loop when all goroutines are blocked
 }
 
-type vgo struct{}
+// std is the standard scheduler
+var std *Scheduler
 
-// Die is invoked after the end of functions called in go statements in the
-// virtualized source. See the doc for Go.
-func Die() {
-	vch <- vdie{}
+func init() {
+	std = newScheduler(1) // count the main go routine
+	traceFromEnv(std)
 }
 
-type vdie struct{}
+// NewScheduler creates a scheduler with no goroutines, whose virtual clock
+// starts at the default epoch
+func NewScheduler() *Scheduler {
+	return newScheduler(0)
+}
 
-// Block is invoked before every blocking channel operation (send, receive,
-// select statements) in the transformed source
-func Block() {
-	vch <- vblock{}
+func newScheduler(ngo int) *Scheduler {
+	s := &Scheduler{
+		ngo:        ngo,
+		epoch:      defaultEpoch(),
+		ondeadlock: exitOnDeadlock,
+		kick:       make(chan struct{}, 1),
+	}
+	s.limit.init()
+	s.quiet.L = &s.mu
+	go s.loop()
+	return s
 }
 
-type vblock struct{}
+// Run calls f in the calling goroutine, which is accounted for as a goroutine
+// of the scheduler until f returns. The goroutines that f starts with virtualized
+// go statements belong to the scheduler as well.
+func (s *Scheduler) Run(f func()) {
+	s.spawn()
+	defer s.bind()()
+	s.started(0)
+	defer s.die()
+	f()
+}
 
-// Unblock is invoked after every blocking channel operation (send, receive,
-// select statements) in the transformed source
-func Unblock() {
-	vch <- vunblock{}
+// Now returns the current virtual time of the scheduler
+func (s *Scheduler) Now() time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.timeAt(s.now)
 }
 
-type vunblock struct{}
+// Sleep pauses the calling goroutine for the duration d of virtual time
+func (s *Scheduler) Sleep(d time.Duration) {
+	s.sleep(int64(d))
+}
 
-// Runtime below
+// Block accounts for the calling goroutine, which runs on the scheduler, entering
+// a blocking channel operation. See Block.
+func (s *Scheduler) Block() {
+	s.mu.Lock()
+	s.nblock++
+	s.emit(EventBlock)
+	s.changed()
+	s.mu.Unlock()
+}
 
-var vch chan interface{}
+// Unblock accounts for the calling goroutine leaving a blocking channel operation.
+// See Unblock.
+func (s *Scheduler) Unblock() {
+	s.mu.Lock()
+	if s.nblock < 1 {
+		panic("no blocked goroutines")
+	}
+	s.nblock--
+	s.emit(EventUnblock)
+	s.changed()
+	s.mu.Unlock()
+}
+// spawn accounts for a new goroutine
+func (s *Scheduler) spawn() {
+	s.mu.Lock()
+	s.ngo++
+	s.changed()
+	s.mu.Unlock()
+}
 
-func init() {
-	vch = make(chan interface{})
-	go loop()
-}
-
-func loop() {
-	var now     int64  // Current virtual time
-	var ngo     int    // Number of active goroutines
-	var nblock  int    // Number of blocked goroutines
-	var q       queue  // Queue of waiting sleep calls
-
-	ngo = 1     // count the main go routine
-	for {
-		vcmd := <-vch
-		switch t := vcmd.(type) {
-		case *vsleep:
-			nblock++
-			q.Add(makeUntil(t, now))
-		case *vnow:
-			t.resp <- now
-			close(t.resp)
-		case vgo:
-			ngo++
-		case vdie:
-			if ngo < 1 {
-				panic("no goroutines")
-			}
-			ngo--
-		case vblock:
-			nblock++
-		case vunblock:
-			if nblock < 1 {
-				panic("no blocked goroutines")
-			}
-			nblock--
-		}
-		if ngo == 0 || nblock < ngo {
-			continue
-		}
-		unsleep := q.DeleteMin()
-		if unsleep == nil {
-			//fmt.Fprintf(os.Stderr, "spinning\n")
-			continue
-		}
-		nblock--
-		if unsleep.when < now {
-			panic("negative time")
+// die accounts for the exit of a goroutine
+func (s *Scheduler) die() {
+	s.mu.Lock()
+	if s.ngo < 1 {
+		panic("no goroutines")
+	}
+	s.ngo--
+	s.emit(EventDie)
+	s.changed()
+	s.mu.Unlock()
+}
+
+// started reports the start of the calling goroutine, spawned by the goroutine
+// parent, to the observers
+func (s *Scheduler) started(parent int64) {
+	if !s.observed.Load() {
+		return
+	}
+	s.mu.Lock()
+	if e := s.event(EventGo); e != nil {
+		e.Parent = parent
+		s.notify(e)
+	}
+	s.mu.Unlock()
+}
+
+// changed is called after every change of the scheduler's state. It wakes up the
+// loop, if all goroutines are blocked, and the goroutines waiting in quiesce.
+// changed is called with the lock held.
+func (s *Scheduler) changed() {
+	s.version.Add(1)
+	if s.nwait > 0 {
+		s.quiet.Broadcast()
+	}
+	if s.blocked() && !s.manual {
+		select {
+		case s.kick <- struct{}{}:
+		default:
 		}
-		now = unsleep.when
-		close(unsleep.wake)
 	}
-	panic("virtual time loop exited")
 }
 
-// queue sorts until instances ascending by timestamp
-type queue []*until
+// blocked reports whether all goroutines are blocked
+func (s *Scheduler) blocked() bool {
+	return s.ngo > 0 && s.nblock >= s.ngo
+}
 
-type until struct {
-	when int64
-	wake chan struct{}
+func (s *Scheduler) sleep(duration int64) {
+	wake := make(chan struct{})
+	s.mu.Lock()
+	unsleep := makeUntil(duration, s.now)
+	unsleep.wake = wake
+	unsleep.sleep = s.emit(EventSleep)
+	s.q.Add(unsleep)
+	s.nblock++
+	s.nsleep++
+	s.changed()
+	s.mu.Unlock()
+	<-wake
 }
 
-func makeUntil(v *vsleep, now int64) *until {
-	return &until{
-		when: now + v.duration,
-		wake: v.wake,
+func (s *Scheduler) loop() {
+	for range s.kick {
+		for s.advance() {
+		}
 	}
 }
 
-func (t queue) Len() int {
-	return len(t)
-}
+// advance is called by the loop. If all goroutines are blocked, it releases the
+// next sleeping goroutine or fires the next timer. It returns false when there is
+// nothing to do until the loop is woken up again.
+func (s *Scheduler) advance() bool {
+	s.mu.Lock()
+	if !s.blocked() || s.manual {
+		s.mu.Unlock()
+		return false
+	}
+	version, settled := s.version.Load(), s.nblock == s.nsleep
+	s.mu.Unlock()
 
-func (t queue) Less(i, j int) bool {
-	return t[i].when < t[j].when
+	// Goroutines blocked in channel operations may be about to proceed
+	if !settled && !s.settle(version) {
+		return true
+	}
+
+	s.mu.Lock()
+	if s.version.Load() != version {
+		s.mu.Unlock()
+		return true
+	}
+	if s.limit.stopped {
+		s.mu.Unlock()
+		return false
+	}
+	if next := s.q.Min(); next != nil && s.exceeds(next.when) {
+		s.stop(next.when)
+		return false
+	}
+	unsleep := s.q.DeleteMin()
+	if unsleep == nil {
+		if s.watched != version {
+			s.watched = version
+			time.AfterFunc(deadlockGrace, func() {
+				s.deadlock(version)
+			})
+		}
+		s.mu.Unlock()
+		return false
+	}
+	at := s.release(unsleep)
+	s.mu.Unlock()
+	if at != nil {
+		s.breakpoint(at)
+	}
+	return true
 }
 
-func (t queue) Swap(i, j int) {
-	t[i], t[j] = t[j], t[i]
+// release advances virtual time to the queue entry unsleep, which was removed
+// from the queue, and wakes up its goroutine or fires its timer. If the entry
+// is a breakpoint, release returns its callback, which the caller must invoke
+// with the breakpoint function after releasing the lock. release is called with
+// the scheduler's lock held.
+func (s *Scheduler) release(unsleep *until) (at func()) {
+	if unsleep.when < s.now {
+		panic("negative time")
+	}
+	s.now = unsleep.when
+	s.events++
+	switch {
+	case unsleep.timer != nil:
+		unsleep.timer.fire()
+	case unsleep.wake != nil:
+		s.nblock--
+		s.nsleep--
+		if e := unsleep.sleep; e != nil && len(s.observers) > 0 {
+			e.Kind = EventWake
+			s.notify(e)
+		}
+		close(unsleep.wake)
+	}
+	s.changed()
+	return unsleep.at
 }
 
-func (t *queue) Add(u *until) {
-	*t = append(*t, u)
-	sort.Sort(t)
+// While waiting for goroutines to report back, the loop yields the processor
+// settleRounds times and then until no goroutines of the scheduler, other than its
+// settling loop, are running or ready to run, but for no longer than settleTimeout
+// of real time.
+// The timeout bounds the wait for goroutines outside of the virtualized source,
+// which may be busy for a long time.
+const (
+	settleRounds  = 8
+	settleTimeout = 10 * time.Millisecond
+)
+
+// settle is called by the loop when all goroutines appear to be blocked. A goroutine
+// may have announced a channel operation that is about to succeed, or it may have
+// been released by a timer. Settle gives such goroutines a chance to run and
+// reports whether the state of the scheduler remained at the given version.
+func (s *Scheduler) settle(version uint64) bool {
+	deadline := time.Now().Add(settleTimeout)
+	for i := 0; ; i++ {
+		runtime.Gosched()
+		if s.version.Load() != version {
+			return false
+		}
+		if i >= settleRounds && (s.idle() || time.Now().After(deadline)) {
+			return true
+		}
+	}
 }
 
-func (t *queue) DeleteMin() *until {
-	if len(*t) == 0 {
-		return nil
+// settleFunc is the stack dump line of a call to settle
+var settleFunc = "\n" + vtimePrefix + "(*Scheduler).settle("
+
+// idle reports whether all goroutines the scheduler owns, other than the settling
+// loops, are waiting. Goroutines of other schedulers do not delay the advance of
+// its clock. The runtime's metrics count the running goroutines only approximately,
+// whereas the stack dump of all goroutines stops the world and reports their exact
+// states.
+func (s *Scheduler) idle() bool {
+	for _, dump := range goroutineStacks() {
+		header, _, _ := strings.Cut(dump, "\n")
+		id, state, _ := strings.Cut(strings.TrimPrefix(header, "goroutine "), " [")
+		if n, err := strconv.ParseInt(id, 10, 64); err == nil && !s.owns(n) {
+			continue
+		}
+		for _, active := range []string{"running", "runnable", "syscall", "preempted", "copystack"} {
+			if strings.HasPrefix(state, active) && !strings.Contains(dump, settleFunc) {
+				return false
+			}
+		}
 	}
-	q := (*t)[0]
-	*t = (*t)[1:]
-	return q
+	return true
 }
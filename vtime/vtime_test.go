@@ -0,0 +1,305 @@
+// Copyright 2012 Petar Maymounkov. All rights reserved.
+// Use of this source code is governed by a 
+// license that can be found in the LICENSE file.
+
+package vtime
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestSchedulers runs two simulations side by side. Each keeps its own clock,
+// which its goroutines, including those started by go statements, share.
+func TestSchedulers(t *testing.T) {
+	elapsed := make(chan time.Duration, 2)
+	for _, d := range []time.Duration{time.Second, time.Hour} {
+		go NewScheduler().Run(func() {
+			start := Now()
+			done := make(chan int)
+			g := Go()
+			go func() {
+				g.Start()
+				Sleep(d)
+				Block()
+				done <- 1
+				Unblock()
+				g.Die()
+			}()
+			Sleep(d / 2)
+			Block()
+			<-done
+			Unblock()
+			elapsed <- Since(start)
+		})
+	}
+	if d := <-elapsed + <-elapsed; d != time.Second+time.Hour {
+		t.Errorf("elapsed %v in total", d)
+	}
+	if now := Now(); now != std.timeAt(0) {
+		t.Errorf("standard clock moved to %v", now)
+	}
+}
+
+// TestAt checks that a breakpoint observes the goroutines sleeping until its
+// instant before they are released
+func TestAt(t *testing.T) {
+	s := NewScheduler()
+	s.Run(func() {
+		start := Now()
+		var n int
+		for i := 0; i < 3; i++ {
+			g := Go()
+			go func() {
+				g.Start()
+				Sleep(time.Second)
+				n++
+				g.Die()
+			}()
+		}
+		At(start.Add(time.Second), func() {
+			if n != 0 {
+				t.Errorf("%d goroutines released before the breakpoint", n)
+			}
+			if d := Since(start); d != time.Second {
+				t.Errorf("breakpoint at %v", d)
+			}
+		})
+		Sleep(2 * time.Second)
+		if n != 3 {
+			t.Errorf("%d goroutines released", n)
+		}
+	})
+}
+
+// TestLimit runs a program that never returns for a bounded amount of virtual time
+// and for a bounded number of events
+func TestLimit(t *testing.T) {
+	for _, c := range []struct {
+		elapsed time.Duration
+		events  int64
+		want    Limit
+	}{
+		{ elapsed: 10 * time.Minute, want: Limit{ Elapsed: 10 * time.Minute, Events: 600 } },
+		{ events: 5, want: Limit{ Elapsed: 5 * time.Second, Events: 5 } },
+	} {
+		s := NewScheduler()
+		s.SetLimit(c.elapsed, c.events)
+		var shutdown []int
+		s.OnShutdown(func() { shutdown = append(shutdown, 1) })
+		s.OnShutdown(func() { shutdown = append(shutdown, 2) })
+		var got *Limit
+		s.OnLimit(func(l *Limit) { got = l })
+		go s.Run(func() {
+			for {
+				Sleep(time.Second)
+			}
+		})
+		<-s.Done()
+		if got.Elapsed != c.want.Elapsed || got.Events != c.want.Events {
+			t.Errorf("stopped after %v and %d events, expecting %v and %d",
+				got.Elapsed, got.Events, c.want.Elapsed, c.want.Events)
+		}
+		if len(shutdown) != 2 || shutdown[0] != 2 {
+			t.Errorf("shutdown hooks called as %v", shutdown)
+		}
+	}
+}
+
+func TestObserve(t *testing.T) {
+	s := NewScheduler()
+	var events []Event
+	// Both goroutines have exited once the second die event is observed
+	exited := make(chan struct{})
+	ndie := 0
+	stop := s.Observe(ObserverFunc(func(e Event) {
+		events = append(events, e)
+		if e.Kind == EventDie {
+			if ndie++; ndie == 2 {
+				close(exited)
+			}
+		}
+	}))
+	s.Run(func() {
+		done := make(chan int)
+		g := Go()
+		go func() {
+			g.Start()
+			Sleep(time.Second)
+			Block()
+			done <- 1
+			Unblock()
+			g.Die()
+		}()
+		Block()
+		<-done
+		Unblock()
+	})
+	<-exited
+	stop()
+	count := map[EventKind]int{}
+	var sleep, wake Event
+	var started []Event
+	for _, e := range events {
+		count[e.Kind]++
+		switch e.Kind {
+		case EventSleep:
+			sleep = e
+		case EventWake:
+			wake = e
+		case EventGo:
+			started = append(started, e)
+		}
+	}
+	if len(started) == 2 && started[1].Parent != started[0].Goroutine {
+		t.Errorf("goroutine %d spawned by %d, expecting %d",
+			started[1].Goroutine, started[1].Parent, started[0].Goroutine)
+	}
+	want := map[EventKind]int{ EventGo: 2, EventDie: 2, EventBlock: 2, EventUnblock: 2, EventSleep: 1, EventWake: 1 }
+	for kind, n := range want {
+		if count[kind] != n {
+			t.Errorf("%d %v events, expecting %d", count[kind], kind, n)
+		}
+	}
+	if sleep.Elapsed != 0 || wake.Elapsed != time.Second {
+		t.Errorf("sleep at %v, wake at %v", sleep.Elapsed, wake.Elapsed)
+	}
+	if wake.Goroutine != sleep.Goroutine || wake.Line != sleep.Line || !strings.HasSuffix(sleep.File, "vtime_test.go") {
+		t.Errorf("sleep %+v, wake %+v", sleep, wake)
+	}
+}
+
+func TestEpoch(t *testing.T) {
+	for _, epoch := range []time.Time{
+		time.Date(2024, 1, 1, 0, 0, 0, 0, time.Local),
+		time.Date(1700, 1, 1, 0, 0, 0, 0, time.UTC),
+		time.Date(2400, 1, 1, 0, 0, 0, 0, time.UTC),
+		time.Date(9999, 12, 31, 23, 59, 59, 0, time.UTC),
+	} {
+		s := NewScheduler()
+		s.SetEpoch(epoch)
+		s.Run(func() {
+			if now := Now(); !now.Equal(epoch) {
+				t.Errorf("now %v, expecting %v", now, epoch)
+			}
+			Sleep(time.Second)
+			if now := Now(); !now.Equal(epoch.Add(time.Second)) || Since(epoch) != time.Second {
+				t.Errorf("now %v after a second, expecting %v", now, epoch.Add(time.Second))
+			}
+		})
+	}
+}
+
+// The benchmarks below measure the overhead the virtual runtime adds to the
+// operations of a virtualized program. The benchmarking goroutine stands in
+// for the main goroutine of the virtualized program.
+
+func BenchmarkNow(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		Now()
+	}
+}
+
+func BenchmarkGoDie(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		Go()
+		Die()
+	}
+}
+
+func BenchmarkBlockUnblock(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		Block()
+		Unblock()
+	}
+}
+
+func BenchmarkSleep(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		Sleep(1)
+	}
+}
+
+// BenchmarkAfter measures advancing virtual time to a timer, which a goroutine
+// waits for in a channel operation
+func BenchmarkAfter(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		c := After(1)
+		Block()
+		<-c
+		Unblock()
+	}
+}
+
+// BenchmarkPingPong measures a round trip between two goroutines over
+// unbuffered channels, the way it looks in virtualized source
+func BenchmarkPingPong(b *testing.B) {
+	ping, pong := make(chan int), make(chan int)
+	Go()
+	go func() {
+		for {
+			Block()
+			n := <-ping
+			Unblock()
+			Block()
+			pong <- n
+			Unblock()
+			if n < 0 {
+				break
+			}
+		}
+		Die()
+	}()
+	for i := 0; i < b.N; i++ {
+		Block()
+		ping <- i
+		Unblock()
+		Block()
+		<-pong
+		Unblock()
+	}
+	Block()
+	ping <- -1
+	Unblock()
+	Block()
+	<-pong
+	Unblock()
+}
+
+// The variants below run the benchmarking goroutine on a scheduler created with
+// NewScheduler. As soon as any goroutine is bound to such a scheduler, every
+// package-level operation finds the scheduler of its goroutine by the runtime ID,
+// which costs a stack dump of the calling goroutine. The methods of the scheduler
+// do without.
+
+func runScheduler(b *testing.B, bench func(*testing.B)) {
+	s := NewScheduler()
+	s.Run(func() {
+		b.ResetTimer()
+		bench(b)
+	})
+}
+
+func BenchmarkNowScheduler(b *testing.B) {
+	runScheduler(b, BenchmarkNow)
+}
+
+func BenchmarkBlockUnblockScheduler(b *testing.B) {
+	runScheduler(b, BenchmarkBlockUnblock)
+}
+
+func BenchmarkSleepScheduler(b *testing.B) {
+	runScheduler(b, BenchmarkSleep)
+}
+
+func BenchmarkBlockUnblockMethods(b *testing.B) {
+	s := NewScheduler()
+	s.Run(func() {
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			s.Block()
+			s.Unblock()
+		}
+	})
+}